@@ -0,0 +1,199 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sqlite/model"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// ErrAdminSelf is returned when an admin tries to disable or impersonate
+// themselves.
+var ErrAdminSelf = errors.New("admins can't do that to themselves")
+
+// ErrImpersonating is returned when an admin impersonating a user tries to
+// change how the user logs in, like adding a passkey, or to delete them.
+var ErrImpersonating = errors.New("not allowed while impersonating")
+
+type AdminService struct {
+	db *DB
+}
+
+func NewAdminService(db *DB) *AdminService {
+	return &AdminService{
+		db: db,
+	}
+}
+
+// GrantAdmin makes an existing user an instance admin. It's how the first
+// admin is created, from the command line, so it isn't audited.
+func (svc *AdminService) GrantAdmin(ctx context.Context, userName string) error {
+	n, err := svc.db.queries(ctx).SetAdmin(ctx, model.SetAdminParams{
+		IsAdmin:  true,
+		UserName: NormalizeUsername(userName),
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no user named %q", userName)
+	}
+	slog.InfoContext(ctx, "granted admin", "user", NormalizeUsername(userName))
+	return nil
+}
+
+// IsAdmin reports whether the authenticated user is an instance admin. An
+// admin impersonating someone is treated as that user, including when the
+// user is an admin themselves.
+func (svc *AdminService) IsAdmin(ctx context.Context) (bool, error) {
+	if ImpersonatorFromContext(ctx) != 0 {
+		return false, nil
+	}
+	user, err := svc.db.readQueries(ctx).GetUserById(ctx, UserFromFromContext(ctx).UserID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.IsAdmin, nil
+}
+
+type AdminOverview struct {
+	Users      []model.ListUsersRow
+	Teams      []model.ListAllTeamsRow
+	TableSizes []TableSize
+	// Size is the size of the database file in bytes.
+	Size  int64
+	Audit []model.ListAdminAuditRow
+}
+
+func (svc *AdminService) Overview(ctx context.Context) (AdminOverview, error) {
+	var overview AdminOverview
+	var err error
+	if overview.Users, err = svc.db.readQueries(ctx).ListUsers(ctx); err != nil {
+		return overview, err
+	}
+	if overview.Teams, err = svc.db.readQueries(ctx).ListAllTeams(ctx); err != nil {
+		return overview, err
+	}
+	if overview.TableSizes, err = svc.db.TableSizes(ctx); err != nil {
+		return overview, err
+	}
+	if overview.Size, err = svc.db.Size(ctx); err != nil {
+		return overview, err
+	}
+	if overview.Audit, err = svc.db.readQueries(ctx).ListAdminAudit(ctx, 50); err != nil {
+		return overview, err
+	}
+	return overview, nil
+}
+
+// audit records an action taken by the authenticated admin, both in the
+// admin_audit table and the server log.
+func audit(ctx context.Context, q *model.Queries, adminID int64, action string, targetUserID int64) error {
+	if targetUserID != 0 {
+		slog.InfoContext(ctx, "admin action", "admin_id", adminID, "action", action, "target_user_id", targetUserID)
+	} else {
+		slog.InfoContext(ctx, "admin action", "admin_id", adminID, "action", action)
+	}
+	return q.CreateAdminAudit(ctx, model.CreateAdminAuditParams{
+		AdminID:      adminID,
+		Action:       action,
+		TargetUserID: sql.NullInt64{Int64: targetUserID, Valid: targetUserID != 0},
+	})
+}
+
+// Record audits an action of the authenticated admin that isn't about a
+// user, like downloading a backup.
+func (svc *AdminService) Record(ctx context.Context, action string) error {
+	return audit(ctx, svc.db.queries(ctx), UserFromFromContext(ctx).UserID, action, 0)
+}
+
+// SetDisabled disables or re-enables a user. Disabled users are logged out
+// everywhere and can't log in again by any means.
+func (svc *AdminService) SetDisabled(ctx context.Context, userID int64, disabled bool) error {
+	adminID := UserFromFromContext(ctx).UserID
+	if userID == adminID {
+		return ErrAdminSelf
+	}
+	return svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		err := q.SetDisabled(ctx, model.SetDisabledParams{
+			DisabledAt: sql.NullTime{Time: time.Now(), Valid: disabled},
+			ID:         userID,
+		})
+		if err != nil {
+			return err
+		}
+		action := "enable"
+		if disabled {
+			action = "disable"
+			if err := q.DeleteUserSessions(ctx, userID); err != nil {
+				return err
+			}
+			// and the sessions they opened as someone else, if they're an admin
+			if err := q.DeleteImpersonationSessions(ctx, userID); err != nil {
+				return err
+			}
+		}
+		return audit(ctx, q, adminID, action, userID)
+	})
+}
+
+// Impersonate opens a short session as another user for support. The
+// session remembers the admin that opened it so every page can say so.
+func (svc *AdminService) Impersonate(ctx context.Context, userID int64) (string, error) {
+	adminID := UserFromFromContext(ctx).UserID
+	if userID == adminID {
+		return "", ErrAdminSelf
+	}
+	var token string
+	err := svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		teamUser, err := q.GetDefaultTeamUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+		disabled, err := q.IsTeamUserDisabled(ctx, teamUser.ID)
+		if err != nil {
+			return err
+		}
+		if disabled {
+			return errAccountDisabled
+		}
+		sessionID, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		token = sessionID.String()
+		err = q.CreateImpersonationSession(ctx, model.CreateImpersonationSessionParams{
+			ID:             token,
+			TeamUserID:     teamUser.ID,
+			ExpiresAt:      time.Now().Add(time.Hour),
+			ImpersonatorID: sql.NullInt64{Int64: adminID, Valid: true},
+		})
+		if err != nil {
+			return err
+		}
+		return audit(ctx, q, adminID, "impersonate", userID)
+	})
+	return token, err
+}
+
+// StopImpersonating ends the impersonation session in the context.
+func (svc *AdminService) StopImpersonating(ctx context.Context, token string) error {
+	adminID := ImpersonatorFromContext(ctx)
+	if adminID == 0 {
+		return nil
+	}
+	return svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		if err := q.DeleteSession(ctx, token); err != nil {
+			return err
+		}
+		return audit(ctx, q, adminID, "stop impersonating", UserFromFromContext(ctx).UserID)
+	})
+}
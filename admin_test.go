@@ -0,0 +1,234 @@
+package sqlite_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sqlite"
+	"sqlite/model"
+	"strings"
+	"testing"
+)
+
+func TestAdminService(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	authService := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+	svc := sqlite.NewAdminService(db)
+	login := func(userName string) string {
+		output, err := authService.Login(ctx, sqlite.AuthInput{
+			UserName: userName,
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output.Token
+	}
+	session := func(token string) context.Context {
+		teamUser, err := authService.GetTeamUserFromSession(ctx, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sqlite.ContextWithUser(ctx, teamUser)
+	}
+	for _, userName := range []string{"alice", "bob"} {
+		if _, err := authService.Signup(ctx, sqlite.AuthInput{UserName: userName, Password: testPassword}); err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+
+	if err := svc.GrantAdmin(ctx, "nobody"); err == nil {
+		t.Fatal("expected granting admin to a missing user to fail")
+	}
+	if err := svc.GrantAdmin(ctx, "Alice"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	alice := session(login("alice"))
+	bobToken := login("bob")
+	bob := sqlite.UserFromFromContext(session(bobToken)).UserID
+	if admin, err := svc.IsAdmin(alice); err != nil || !admin {
+		t.Fatalf("expected alice to be an admin, got %v %v", admin, err)
+	}
+	if admin, err := svc.IsAdmin(session(bobToken)); err != nil || admin {
+		t.Fatalf("expected bob to not be an admin, got %v %v", admin, err)
+	}
+
+	// disabling logs bob out and keeps him out
+	if err := svc.SetDisabled(alice, sqlite.UserFromFromContext(alice).UserID, true); err != sqlite.ErrAdminSelf {
+		t.Fatalf("expected ErrAdminSelf, got %v", err)
+	}
+	if err := svc.SetDisabled(alice, bob, true); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if teamUser, _ := authService.GetTeamUserFromSession(ctx, bobToken); teamUser.ID != 0 {
+		t.Fatal("expected the session of a disabled user to be gone")
+	}
+	if login("bob") != "" {
+		t.Fatal("expected a disabled user to not log in")
+	}
+	if _, err := svc.Impersonate(alice, bob); err == nil {
+		t.Fatal("expected a disabled user to not be impersonated")
+	}
+	if err := svc.SetDisabled(alice, bob, false); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if login("bob") == "" {
+		t.Fatal("expected an enabled user to log in")
+	}
+
+	// impersonating acts as bob but is never an admin
+	token, err := svc.Impersonate(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	// the middleware is what knows about the impersonator
+	var impersonated context.Context
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	authService.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		impersonated = r.Context()
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if sqlite.UserFromFromContext(impersonated).UserID != bob {
+		t.Fatal("expected the impersonation session to belong to bob")
+	}
+	if sqlite.ImpersonatorFromContext(impersonated) != sqlite.UserFromFromContext(alice).UserID {
+		t.Fatal("expected alice to be the impersonator")
+	}
+	if admin, err := svc.IsAdmin(impersonated); err != nil || admin {
+		t.Fatalf("expected an impersonation to not be an admin, got %v %v", admin, err)
+	}
+	// nor can it take the account over or delete it
+	if _, err := authService.ChangePassword(impersonated, sqlite.ChangePasswordInput{CurrentPassword: testPassword, NewPassword: "another " + testPassword}); err != sqlite.ErrImpersonating {
+		t.Fatalf("expected ErrImpersonating changing the password, got %v", err)
+	}
+	emailService := sqlite.NewEmailService(db, sqlite.EmailConfig{Mailer: sqlite.FileMailer{Dir: t.TempDir()}})
+	if err := emailService.SetEmail(impersonated, "alice@example.com"); err != sqlite.ErrImpersonating {
+		t.Fatalf("expected ErrImpersonating changing the email, got %v", err)
+	}
+	if err := sqlite.NewUserService(db).Delete(impersonated, "bob"); err != sqlite.ErrImpersonating {
+		t.Fatalf("expected ErrImpersonating deleting the account, got %v", err)
+	}
+	webAuthnService, err := sqlite.NewWebAuthnService(db, sqlite.WebAuthnConfig{
+		RPID:          "localhost",
+		RPDisplayName: "Dials",
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if _, _, err := webAuthnService.BeginRegistration(impersonated); err != sqlite.ErrImpersonating {
+		t.Fatalf("expected ErrImpersonating adding a passkey, got %v", err)
+	}
+	if err := webAuthnService.FinishRegistration(impersonated, "ceremony", strings.NewReader("{}")); err != sqlite.ErrImpersonating {
+		t.Fatalf("expected ErrImpersonating finishing a passkey, got %v", err)
+	}
+	if err := svc.StopImpersonating(impersonated, token); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if teamUser, _ := authService.GetTeamUserFromSession(ctx, token); teamUser.ID != 0 {
+		t.Fatal("expected the impersonation session to be gone")
+	}
+
+	overview, err := svc.Overview(alice)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(overview.Users) != 2 || len(overview.Teams) != 2 {
+		t.Fatalf("expected 2 users and teams, got %d and %d", len(overview.Users), len(overview.Teams))
+	}
+	if overview.Size == 0 {
+		t.Fatal("expected a database size")
+	}
+	rows := map[string]int64{}
+	for _, table := range overview.TableSizes {
+		rows[table.Name] = table.Rows
+	}
+	if rows["user"] != 2 || rows["team"] != 2 {
+		t.Fatalf("expected 2 users and teams in table sizes, got %v", rows)
+	}
+	var actions []string
+	for _, entry := range overview.Audit {
+		actions = append(actions, entry.Action)
+		if entry.AdminName.String != "alice" || entry.TargetName.String != "bob" {
+			t.Fatalf("expected alice acting on bob, got %+v", entry)
+		}
+	}
+	if len(actions) != 4 || actions[0] != "stop impersonating" || actions[1] != "impersonate" || actions[2] != "enable" || actions[3] != "disable" {
+		t.Fatalf("expected the audit log to record every action, got %v", actions)
+	}
+
+	// impersonations end with the admin role of who opened them
+	if token, err = svc.Impersonate(alice, bob); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if _, err := db.Queries.SetAdmin(ctx, model.SetAdminParams{IsAdmin: false, UserName: "alice"}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if teamUser, _ := authService.GetTeamUserFromSession(ctx, token); teamUser.ID != 0 {
+		t.Fatal("expected the impersonation session of a former admin to be gone")
+	}
+}
+
+func TestDisableAdmin(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	authService := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+	svc := sqlite.NewAdminService(db)
+	admins := map[string]context.Context{}
+	for _, userName := range []string{"alice", "carol", "bob"} {
+		if _, err := authService.Signup(ctx, sqlite.AuthInput{UserName: userName, Password: testPassword}); err != nil {
+			t.Fatal(err)
+			return
+		}
+		output, err := authService.Login(ctx, sqlite.AuthInput{UserName: userName, Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		teamUser, err := authService.GetTeamUserFromSession(ctx, output.Token)
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		admins[userName] = sqlite.ContextWithUser(ctx, teamUser)
+	}
+	for _, userName := range []string{"alice", "carol"} {
+		if err := svc.GrantAdmin(ctx, userName); err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	bob := sqlite.UserFromFromContext(admins["bob"]).UserID
+	token, err := svc.Impersonate(admins["alice"], bob)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	// disabling an admin ends the sessions they opened as someone else
+	if err := svc.SetDisabled(admins["carol"], sqlite.UserFromFromContext(admins["alice"]).UserID, true); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if teamUser, _ := authService.GetTeamUserFromSession(ctx, token); teamUser.ID != 0 {
+		t.Fatal("expected the impersonation session of a disabled admin to be gone")
+	}
+}
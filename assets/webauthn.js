@@ -0,0 +1,64 @@
+// helpers for the passkey ceremonies. the server speaks base64url for every
+// binary field, the browser wants ArrayBuffers.
+(() => {
+  const decode = (value) => {
+    const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    const padded = base64 + "=".repeat((4 - (base64.length % 4)) % 4);
+    return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+  };
+
+  const encode = (buffer) => {
+    const bytes = String.fromCharCode(...new Uint8Array(buffer));
+    return btoa(bytes).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  };
+
+  const post = async (url, body) => {
+    const res = await fetch(url, {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+        "X-CSRF-Token": document.querySelector('meta[name="csrf-token"]').content,
+      },
+      body: body && JSON.stringify(body),
+    });
+    if (!res.ok) {
+      throw new Error("request failed: " + res.status);
+    }
+    return res;
+  };
+
+  window.registerPasskey = async () => {
+    const { publicKey } = await (await post("/passkeys/begin")).json();
+    publicKey.challenge = decode(publicKey.challenge);
+    publicKey.user.id = decode(publicKey.user.id);
+    (publicKey.excludeCredentials || []).forEach((c) => (c.id = decode(c.id)));
+    const credential = await navigator.credentials.create({ publicKey });
+    await post("/passkeys/finish", {
+      id: credential.id,
+      rawId: encode(credential.rawId),
+      type: credential.type,
+      response: {
+        clientDataJSON: encode(credential.response.clientDataJSON),
+        attestationObject: encode(credential.response.attestationObject),
+        transports: credential.response.getTransports ? credential.response.getTransports() : [],
+      },
+    });
+  };
+
+  window.loginWithPasskey = async () => {
+    const { publicKey } = await (await post("/login/passkey/begin")).json();
+    publicKey.challenge = decode(publicKey.challenge);
+    const credential = await navigator.credentials.get({ publicKey });
+    await post("/login/passkey/finish", {
+      id: credential.id,
+      rawId: encode(credential.rawId),
+      type: credential.type,
+      response: {
+        clientDataJSON: encode(credential.response.clientDataJSON),
+        authenticatorData: encode(credential.response.authenticatorData),
+        signature: encode(credential.response.signature),
+        userHandle: credential.response.userHandle && encode(credential.response.userHandle),
+      },
+    });
+  };
+})();
@@ -3,56 +3,115 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"log/slog"
 	"net/http"
 	"sqlite/model"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
+type AuthConfig struct {
+	// RateLimit applies to login, signup and password change attempts, the
+	// zero value uses DefaultRateLimitConfig.
+	RateLimit RateLimitConfig
+	// PasswordPolicy applies to signups and password changes, the zero
+	// value uses DefaultPasswordPolicy.
+	PasswordPolicy PasswordPolicy
+	// PasswordHasher hashes new passwords, nil uses DefaultPasswordHasher.
+	// Users with a hash it considers outdated are rehashed when they log in.
+	PasswordHasher PasswordHasher
+}
+
 type AuthService struct {
-	db *DB
+	db             *DB
+	limiter        *RateLimiter
+	passwordPolicy PasswordPolicy
+	hasher         PasswordHasher
+	// dummyHash is compared against when a username doesn't exist so that
+	// unknown and known usernames take the same time to fail.
+	dummyHash func() []byte
 }
 
-func NewAuthService(db *DB) *AuthService {
+func NewAuthService(db *DB, config AuthConfig) *AuthService {
+	if config.RateLimit == (RateLimitConfig{}) {
+		config.RateLimit = DefaultRateLimitConfig
+	}
+	if config.PasswordPolicy == (PasswordPolicy{}) {
+		config.PasswordPolicy = DefaultPasswordPolicy
+	}
+	if config.PasswordHasher == nil {
+		config.PasswordHasher = DefaultPasswordHasher
+	}
 	return &AuthService{
-		db: db,
+		db:             db,
+		limiter:        NewRateLimiter(db, config.RateLimit),
+		passwordPolicy: config.PasswordPolicy,
+		hasher:         config.PasswordHasher,
+		dummyHash: sync.OnceValue(func() []byte {
+			hash, _ := config.PasswordHasher.Hash("dummy password")
+			return hash
+		}),
 	}
 }
 
 type AuthInput struct {
 	UserName string
 	Password string
+	// RemoteIP is rate limited along with the username when set.
+	RemoteIP string
 }
 
 type AuthOutput struct {
 	Token string
 	OK    bool
+	// RetryAfter is set when the attempt was refused by the rate limiter.
+	RetryAfter time.Duration
+	// UsernameErrors lists the rules a new username broke.
+	UsernameErrors []string
+	// PasswordErrors lists the password policy rules a new password broke.
+	PasswordErrors []string
 }
 
+var errUsernameClaimed = errors.New("username already claimed")
+
+// errAccountDisabled is returned by createSession for users an admin has
+// disabled, whichever way they tried to log in.
+var errAccountDisabled = errors.New("account disabled")
+
 func (svc *AuthService) Signup(ctx context.Context, input AuthInput) (AuthOutput, error) {
-	userName := strings.ToLower(input.UserName)
-	_, err := svc.db.Queries.GetUserByUsername(ctx, userName)
-	if err == nil {
+	if input.RemoteIP != "" {
+		// every signup counts against the address, not just failed ones, so
+		// accounts can't be mass created
+		wait, err := svc.limiter.Attempt(ctx, "signup:"+input.RemoteIP)
+		if err != nil {
+			return AuthOutput{}, err
+		}
+		if wait > 0 {
+			authFailures.WithLabelValues("signup", "rate_limited").Inc()
+			return AuthOutput{OK: false, RetryAfter: wait}, nil
+		}
+	}
+	userName, usernameProblems := CheckUsername(input.UserName)
+	passwordProblems := svc.passwordPolicy.Check(userName, input.Password)
+	if len(usernameProblems) > 0 || len(passwordProblems) > 0 {
 		return AuthOutput{
-			OK: false,
+			OK:             false,
+			UsernameErrors: usernameProblems,
+			PasswordErrors: passwordProblems,
 		}, nil
 	}
-	if err != sql.ErrNoRows {
-		return AuthOutput{}, err
-	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), 10)
+	hash, err := svc.hasher.Hash(input.Password)
 	if err != nil {
 		return AuthOutput{}, err
 	}
 	var tuID int64
 	err = svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
-		userID, err := q.CreateUser(ctx, model.CreateUserParams{
-			UserName: userName,
-			Password: hash,
-		})
+		userID, err := createUser(ctx, q, userName, hash)
 		if err != nil {
 			return err
 		}
@@ -72,55 +131,130 @@ func (svc *AuthService) Signup(ctx context.Context, input AuthInput) (AuthOutput
 			ID:        tuID,
 		})
 	})
+	if err == errUsernameClaimed {
+		authFailures.WithLabelValues("signup", "username_claimed").Inc()
+		return AuthOutput{
+			OK: false,
+		}, nil
+	}
 	if err != nil {
 		return AuthOutput{}, err
 	}
-	sessionID, err := uuid.NewV4()
+	token, err := createSession(ctx, svc.db.queries(ctx), tuID)
 	if err != nil {
 		return AuthOutput{}, err
 	}
-	token := sessionID.String()
-	svc.db.Queries.CreateSession(ctx, model.CreateSessionParams{
-		ID:         token,
-		TeamUserID: tuID,
-		ExpiresAt:  time.Now().AddDate(0, 0, 30),
-	})
 	return AuthOutput{
 		Token: token,
 		OK:    true,
 	}, nil
 }
 
-func (svc *AuthService) Login(ctx context.Context, input AuthInput) (AuthOutput, error) {
-	userName := strings.ToLower(input.UserName)
-	user, err := svc.db.Queries.GetUserByUsername(ctx, userName)
+// createUser inserts a user with an already normalized username. The name is
+// claimed if it, or one that looks like it, is taken. The unique constraint
+// settles races between concurrent signups.
+func createUser(ctx context.Context, q *model.Queries, userName string, hash []byte) (int64, error) {
+	skeleton := usernameSkeleton(userName)
+	exists, err := q.UsernameSkeletonExists(ctx, skeleton)
 	if err != nil {
-		// if the user doesn't exist they cannot login
-		if err == sql.ErrNoRows {
-			return AuthOutput{OK: false}, nil
-		}
-		// otherwise something unexpected happened
+		return 0, err
+	}
+	if exists != 0 {
+		return 0, errUsernameClaimed
+	}
+	userID, err := q.CreateUser(ctx, model.CreateUserParams{
+		UserName:         userName,
+		UserNameSkeleton: skeleton,
+		Password:         hash,
+	})
+	if isUniqueViolation(err) {
+		return 0, errUsernameClaimed
+	}
+	return userID, err
+}
+
+func (svc *AuthService) Login(ctx context.Context, input AuthInput) (AuthOutput, error) {
+	// usernames can't contain an @, so anything that does is an email
+	login := NormalizeUsername(input.UserName)
+	var user model.User
+	var err error
+	if strings.Contains(login, "@") {
+		login = normalizeEmail(input.UserName)
+		user, err = svc.db.queries(ctx).GetUserByVerifiedEmail(ctx, sql.NullString{String: login, Valid: true})
+	} else {
+		user, err = svc.db.queries(ctx).GetUserByUsername(ctx, login)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		// something unexpected happened
 		return AuthOutput{}, err
 	}
-	err = bcrypt.CompareHashAndPassword(user.Password, []byte(input.Password))
+	missing := err == sql.ErrNoRows
+	// failures count against the account whether or not it exists, so a
+	// lockout doesn't reveal which usernames are real. Known accounts are
+	// keyed by username so switching to the email doesn't get more attempts.
+	keys := []string{"user:" + login}
+	if !missing {
+		keys[0] = "user:" + user.UserName
+	}
+	if input.RemoteIP != "" {
+		keys = append(keys, "ip:"+input.RemoteIP)
+	}
+	// the attempt counts as failed until the password is known to match
+	wait, err := svc.limiter.Attempt(ctx, keys...)
 	if err != nil {
+		return AuthOutput{}, err
+	}
+	if wait > 0 {
+		authFailures.WithLabelValues("login", "rate_limited").Inc()
+		return AuthOutput{OK: false, RetryAfter: wait}, nil
+	}
+	hash := user.Password
+	if missing {
+		// if the user doesn't exist they cannot login, but still pay for a
+		// compare so the response takes as long as a wrong password
+		hash = svc.dummyHash()
+	}
+	if !comparePassword(hash, input.Password) || missing {
 		// if the password doesn't match they cannot login
+		authFailures.WithLabelValues("login", "invalid_credentials").Inc()
 		return AuthOutput{OK: false}, nil
 	}
-	teamUser, err := svc.db.Queries.GetDefaultTeamUser(ctx, user.ID)
+	// only the account is reset, otherwise logging into your own account
+	// would reset an address that is guessing at others. The address only
+	// gets this attempt back.
+	if err := svc.limiter.Reset(ctx, keys[0]); err != nil {
+		return AuthOutput{}, err
+	}
+	if err := svc.limiter.Forgive(ctx, keys[1:]...); err != nil {
+		return AuthOutput{}, err
+	}
+	// this is the only time the plain password is known, so it's the only
+	// chance to move the user onto the current hasher
+	if svc.hasher.NeedsRehash(hash) {
+		hash, err := svc.hasher.Hash(input.Password)
+		if err != nil {
+			return AuthOutput{}, err
+		}
+		err = svc.db.queries(ctx).SetPassword(ctx, model.SetPasswordParams{
+			Password: hash,
+			ID:       user.ID,
+		})
+		if err != nil {
+			return AuthOutput{}, err
+		}
+	}
+	teamUser, err := svc.db.queries(ctx).GetDefaultTeamUser(ctx, user.ID)
 	if err != nil {
 		return AuthOutput{}, err
 	}
-	sessionID, err := uuid.NewV4()
+	token, err := createSession(ctx, svc.db.queries(ctx), teamUser.ID)
+	if err == errAccountDisabled {
+		authFailures.WithLabelValues("login", "disabled").Inc()
+		return AuthOutput{OK: false}, nil
+	}
 	if err != nil {
 		return AuthOutput{}, err
 	}
-	token := sessionID.String()
-	svc.db.Queries.CreateSession(ctx, model.CreateSessionParams{
-		ID:         token,
-		TeamUserID: teamUser.ID,
-		ExpiresAt:  time.Now().AddDate(0, 0, 30),
-	})
 	// otherwise we're in
 	return AuthOutput{
 		Token: token,
@@ -128,22 +262,138 @@ func (svc *AuthService) Login(ctx context.Context, input AuthInput) (AuthOutput,
 	}, nil
 }
 
+type ChangePasswordInput struct {
+	CurrentPassword string
+	NewPassword     string
+}
+
+// ChangePassword sets a new password for the authenticated user. OK is false
+// when the current password is wrong or the new one breaks the policy. Admins
+// impersonating the user can't change it.
+func (svc *AuthService) ChangePassword(ctx context.Context, input ChangePasswordInput) (AuthOutput, error) {
+	if ImpersonatorFromContext(ctx) != 0 {
+		return AuthOutput{}, ErrImpersonating
+	}
+	user, err := svc.db.queries(ctx).GetUserById(ctx, UserFromFromContext(ctx).UserID)
+	if err != nil {
+		return AuthOutput{}, err
+	}
+	// a stolen session mustn't be a way to guess the password without limit
+	key := "password:" + strconv.FormatInt(user.ID, 10)
+	wait, err := svc.limiter.Attempt(ctx, key)
+	if err != nil {
+		return AuthOutput{}, err
+	}
+	if wait > 0 {
+		authFailures.WithLabelValues("change_password", "rate_limited").Inc()
+		return AuthOutput{OK: false, RetryAfter: wait}, nil
+	}
+	if !comparePassword(user.Password, input.CurrentPassword) {
+		authFailures.WithLabelValues("change_password", "invalid_credentials").Inc()
+		return AuthOutput{OK: false}, nil
+	}
+	if err := svc.limiter.Reset(ctx, key); err != nil {
+		return AuthOutput{}, err
+	}
+	if problems := svc.passwordPolicy.Check(user.UserName, input.NewPassword); len(problems) > 0 {
+		return AuthOutput{OK: false, PasswordErrors: problems}, nil
+	}
+	hash, err := svc.hasher.Hash(input.NewPassword)
+	if err != nil {
+		return AuthOutput{}, err
+	}
+	err = svc.db.queries(ctx).SetPassword(ctx, model.SetPasswordParams{
+		Password: hash,
+		ID:       user.ID,
+	})
+	if err != nil {
+		return AuthOutput{}, err
+	}
+	return AuthOutput{OK: true}, nil
+}
+
+// createSession issues a new session token for the team user. Every way of
+// logging in ends here so they all produce the same kind of session.
+func createSession(ctx context.Context, q *model.Queries, teamUserID int64) (string, error) {
+	disabled, err := q.IsTeamUserDisabled(ctx, teamUserID)
+	if err != nil {
+		return "", err
+	}
+	if disabled {
+		return "", errAccountDisabled
+	}
+	sessionID, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	token := sessionID.String()
+	err = q.CreateSession(ctx, model.CreateSessionParams{
+		ID:         token,
+		TeamUserID: teamUserID,
+		ExpiresAt:  time.Now().AddDate(0, 0, 30),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
 func (svc *AuthService) GetTeamUserFromSession(ctx context.Context, token string) (model.TeamUser, error) {
-	session, err := svc.db.Queries.GetSession(ctx, token)
+	teamUser, _, err := svc.getSession(ctx, token)
+	return teamUser, err
+}
+
+// getSession also returns the id of the admin impersonating the user, or 0.
+func (svc *AuthService) getSession(ctx context.Context, token string) (model.TeamUser, int64, error) {
+	session, err := svc.db.readQueries(ctx).GetSession(ctx, token)
 	if err != nil {
-		return model.TeamUser{}, err
+		return model.TeamUser{}, 0, err
 	}
-	if session.Expired {
-		svc.db.Queries.DeleteSession(ctx, token)
-		return model.TeamUser{}, nil
+	// disabling a user deletes their sessions and the ones they opened as an
+	// admin, this only catches a session created while that was happening,
+	// or one opened by an admin who has since lost the role
+	if session.Expired || session.Disabled {
+		svc.db.queries(ctx).DeleteSession(ctx, token)
+		return model.TeamUser{}, 0, nil
 	}
-	return svc.db.Queries.GetTeamUser(ctx, session.TeamUserID)
+	teamUser, err := svc.db.readQueries(ctx).GetTeamUser(ctx, session.TeamUserID)
+	return teamUser, session.ImpersonatorID.Int64, err
+}
+
+// PurgeExpired deletes the sessions and the sign in and verification tokens
+// that have expired, and the rate limited keys that were forgotten, for the
+// scheduler to run now and then.
+func (svc *AuthService) PurgeExpired(ctx context.Context) error {
+	var purged int64
+	err := svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		purged = 0
+		for _, purge := range []func(context.Context) (int64, error){
+			q.DeleteExpiredSessions,
+			q.DeleteExpiredWebAuthnSessions,
+			q.DeleteExpiredOIDCStates,
+			q.DeleteExpiredEmailVerifications,
+			svc.limiter.Purge,
+		} {
+			n, err := purge(ctx)
+			if err != nil {
+				return err
+			}
+			purged += n
+		}
+		return nil
+	})
+	if err == nil && purged > 0 {
+		slog.InfoContext(ctx, "purged expired sessions, tokens and login attempts", "count", purged)
+	}
+	return err
 }
 
 type contextKey struct{}
 
 var key contextKey
 
+type impersonatorKey struct{}
+
 func ContextWithUser(ctx context.Context, i model.TeamUser) context.Context {
 	return context.WithValue(ctx, &key, i)
 }
@@ -160,14 +410,23 @@ func UserFromFromContext(ctx context.Context) model.TeamUser {
 	return model.TeamUser{}
 }
 
+// ImpersonatorFromContext returns the id of the admin acting as the user in
+// the context, or 0 when the user is themselves.
+func ImpersonatorFromContext(ctx context.Context) int64 {
+	id, _ := ctx.Value(impersonatorKey{}).(int64)
+	return id
+}
+
 func (svc *AuthService) Middleware(handle http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if cookie, err := r.Cookie("token"); err == nil {
-			if tu, err := svc.GetTeamUserFromSession(r.Context(), cookie.Value); err == nil && tu.ID != 0 {
+			if tu, impersonator, err := svc.getSession(r.Context(), cookie.Value); err == nil && tu.ID != 0 {
 				// if we got a user, put it in the request context
 				r = RequestWithUser(r, tu)
-
-			} else if err != sql.ErrNoRows {
+				if impersonator != 0 {
+					r = r.WithContext(context.WithValue(r.Context(), impersonatorKey{}, impersonator))
+				}
+			} else if err != nil && err != sql.ErrNoRows {
 				// ErrNoRows just means that there isn't a session
 				// any other error means something unexpected happened
 				handleError(w, r, err)
@@ -1,11 +1,21 @@
 package sqlite_test
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"path/filepath"
 	"sqlite"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// testPassword satisfies the default password policy
+const testPassword = "correct horse battery"
+
 func TestAuthServiceSignup(t *testing.T) {
 	ctx := context.Background()
 	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
@@ -13,12 +23,12 @@ func TestAuthServiceSignup(t *testing.T) {
 		t.Fatal(err)
 		return
 	}
-	svc := sqlite.NewAuthService(db)
+	svc := sqlite.NewAuthService(db, sqlite.AuthConfig{})
 
 	// sign up with new creds
 	output, err := svc.Signup(ctx, sqlite.AuthInput{
 		UserName: "test",
-		Password: "test",
+		Password: testPassword,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -41,7 +51,7 @@ func TestAuthServiceSignup(t *testing.T) {
 	// sign up with the existing creds
 	output, err = svc.Signup(ctx, sqlite.AuthInput{
 		UserName: "test",
-		Password: "test",
+		Password: testPassword,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -60,17 +70,17 @@ func TestAuthServiceLogin(t *testing.T) {
 		t.Fatal(err)
 		return
 	}
-	svc := sqlite.NewAuthService(db)
+	svc := sqlite.NewAuthService(db, sqlite.AuthConfig{})
 
 	svc.Signup(ctx, sqlite.AuthInput{
 		UserName: "test",
-		Password: "test",
+		Password: testPassword,
 	})
 
 	// login with the correct creds
 	output, err := svc.Login(ctx, sqlite.AuthInput{
 		UserName: "test",
-		Password: "test",
+		Password: testPassword,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -96,7 +106,7 @@ func TestAuthServiceLogin(t *testing.T) {
 	// login with an invalid username
 	output, err = svc.Login(ctx, sqlite.AuthInput{
 		UserName: "test wrong",
-		Password: "test",
+		Password: testPassword,
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -106,3 +116,461 @@ func TestAuthServiceLogin(t *testing.T) {
 		t.Fatal("expected failed login")
 	}
 }
+
+func TestAuthServiceRateLimit(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	svc := sqlite.NewAuthService(db, sqlite.AuthConfig{
+		RateLimit: sqlite.RateLimitConfig{
+			FreeAttempts: 2,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			ResetAfter:   time.Hour,
+		},
+	})
+
+	svc.Signup(ctx, sqlite.AuthInput{
+		UserName: "test",
+		Password: testPassword,
+	})
+
+	// use up the free attempts
+	for i := 0; i < 2; i++ {
+		output, err := svc.Login(ctx, sqlite.AuthInput{
+			UserName: "test",
+			Password: "test wrong",
+			RemoteIP: "10.0.0.1",
+		})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		if output.OK || output.RetryAfter != 0 {
+			t.Fatal("expected failed login without lockout")
+		}
+	}
+
+	// the account is locked, even from another address with the right password
+	output, err := svc.Login(ctx, sqlite.AuthInput{
+		UserName: "test",
+		Password: testPassword,
+		RemoteIP: "10.0.0.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if output.OK || output.RetryAfter == 0 {
+		t.Fatal("expected locked out login")
+	}
+
+	// the address is locked for other accounts too
+	output, err = svc.Login(ctx, sqlite.AuthInput{
+		UserName: "other",
+		Password: testPassword,
+		RemoteIP: "10.0.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if output.RetryAfter == 0 {
+		t.Fatal("expected locked out login")
+	}
+
+	// unknown usernames are locked out the same way as real ones
+	for i := 0; i < 2; i++ {
+		svc.Login(ctx, sqlite.AuthInput{
+			UserName: "nobody",
+			Password: testPassword,
+		})
+	}
+	output, err = svc.Login(ctx, sqlite.AuthInput{
+		UserName: "nobody",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if output.RetryAfter == 0 {
+		t.Fatal("expected locked out login")
+	}
+
+	// signups are limited per address
+	for i := 0; i < 2; i++ {
+		output, err := svc.Signup(ctx, sqlite.AuthInput{
+			UserName: fmt.Sprintf("new%d", i),
+			Password: testPassword,
+			RemoteIP: "10.0.0.3",
+		})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		if !output.OK {
+			t.Fatal("expected successful signup")
+		}
+	}
+	output, err = svc.Signup(ctx, sqlite.AuthInput{
+		UserName: "new2",
+		Password: testPassword,
+		RemoteIP: "10.0.0.3",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if output.OK || output.RetryAfter == 0 {
+		t.Fatal("expected rate limited signup")
+	}
+}
+
+func TestAuthServiceRateLimitParallel(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	svc := sqlite.NewAuthService(db, sqlite.AuthConfig{
+		RateLimit: sqlite.RateLimitConfig{
+			FreeAttempts: 2,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			ResetAfter:   time.Hour,
+		},
+	})
+	if _, err := svc.Signup(ctx, sqlite.AuthInput{UserName: "test", Password: testPassword}); err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	// logging in doesn't count against the address
+	for i := 0; i < 3; i++ {
+		output, err := svc.Login(ctx, sqlite.AuthInput{UserName: "test", Password: testPassword, RemoteIP: "10.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		if !output.OK {
+			t.Fatalf("expected login %d to succeed", i)
+		}
+	}
+
+	// guesses made all at once are limited like guesses made one by one
+	var wg sync.WaitGroup
+	var guessed atomic.Int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output, err := svc.Login(ctx, sqlite.AuthInput{UserName: "test", Password: "test wrong", RemoteIP: "10.0.0.2"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if output.RetryAfter == 0 {
+				guessed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if guessed.Load() != 2 {
+		t.Fatalf("expected 2 guesses before the lockout, got %d", guessed.Load())
+	}
+}
+
+func TestAuthServicePasswordPolicy(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	svc := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+
+	tests := map[string]int{
+		"short":                 1,
+		"password123":           1,
+		"PASSWORD123":           1,
+		"mytester99":            1,
+		"retset":                2,
+		strings.Repeat("x", 73): 1,
+		"abc":                   1,
+		"":                      1,
+		testPassword:            0,
+	}
+	for password, count := range tests {
+		output, err := svc.Signup(ctx, sqlite.AuthInput{
+			UserName: "tester",
+			Password: password,
+		})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		if len(output.PasswordErrors) != count {
+			t.Errorf("password %q: expected %d errors, got %v", password, count, output.PasswordErrors)
+		}
+	}
+
+	// change the password of the user that signed up
+	output, err := svc.Login(ctx, sqlite.AuthInput{
+		UserName: "tester",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	teamUser, err := svc.GetTeamUserFromSession(ctx, output.Token)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	ctx = sqlite.ContextWithUser(ctx, teamUser)
+
+	output, err = svc.ChangePassword(ctx, sqlite.ChangePasswordInput{
+		CurrentPassword: "wrong",
+		NewPassword:     "a new correct horse",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if output.OK {
+		t.Fatal("expected the wrong current password to be refused")
+	}
+	output, err = svc.ChangePassword(ctx, sqlite.ChangePasswordInput{
+		CurrentPassword: testPassword,
+		NewPassword:     "letmein123",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if output.OK || len(output.PasswordErrors) != 1 {
+		t.Fatalf("expected one password error, got %v", output.PasswordErrors)
+	}
+	output, err = svc.ChangePassword(ctx, sqlite.ChangePasswordInput{
+		CurrentPassword: testPassword,
+		NewPassword:     "a new correct horse",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if !output.OK {
+		t.Fatal("expected the password to change")
+	}
+	output, err = svc.Login(ctx, sqlite.AuthInput{
+		UserName: "tester",
+		Password: "a new correct horse",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if !output.OK {
+		t.Fatal("expected login with the new password")
+	}
+
+	// guesses of the current password are limited like logins
+	limited := sqlite.NewAuthService(db, sqlite.AuthConfig{
+		RateLimit: sqlite.RateLimitConfig{
+			FreeAttempts: 2,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			ResetAfter:   time.Hour,
+		},
+	})
+	for i := 0; i < 2; i++ {
+		output, err = limited.ChangePassword(ctx, sqlite.ChangePasswordInput{
+			CurrentPassword: "wrong",
+			NewPassword:     "yet another correct horse",
+		})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	output, err = limited.ChangePassword(ctx, sqlite.ChangePasswordInput{
+		CurrentPassword: "a new correct horse",
+		NewPassword:     "yet another correct horse",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if output.OK || output.RetryAfter == 0 {
+		t.Fatalf("expected the change to be rate limited, got %+v", output)
+	}
+}
+
+func TestAuthServiceUsername(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	svc := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+
+	tests := map[string]int{
+		"ab":                    1,
+		"admin":                 1,
+		"Adm1n":                 1,
+		"a.d.m.i.n":             1,
+		"bad name":              1,
+		"-abc":                  1,
+		"élan":                  1,
+		strings.Repeat("a", 33): 1,
+		"_":                     2,
+	}
+	for userName, count := range tests {
+		output, err := svc.Signup(ctx, sqlite.AuthInput{
+			UserName: userName,
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		if output.OK || len(output.UsernameErrors) != count {
+			t.Errorf("username %q: expected %d errors, got %v", userName, count, output.UsernameErrors)
+		}
+	}
+
+	// fullwidth letters and case fold to the plain name
+	output, err := svc.Signup(ctx, sqlite.AuthInput{
+		UserName: "  Ｊａｎｅ.Doe ",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if !output.OK {
+		t.Fatalf("expected signup to succeed, got %v", output.UsernameErrors)
+	}
+	output, err = svc.Login(ctx, sqlite.AuthInput{
+		UserName: "jane.doe",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if !output.OK {
+		t.Fatal("expected login with the normalized username")
+	}
+
+	for _, userName := range []string{"jane.doe", "JANE.DOE", "janed0e", "jane_doe", "jane-d0e"} {
+		output, err := svc.Signup(ctx, sqlite.AuthInput{
+			UserName: userName,
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		if output.OK {
+			t.Errorf("username %q: expected it to be claimed by jane.doe", userName)
+		}
+	}
+}
+
+func TestAuthServiceRehash(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	login := func(hasher sqlite.PasswordHasher) []byte {
+		svc := sqlite.NewAuthService(db, sqlite.AuthConfig{PasswordHasher: hasher})
+		output, err := svc.Login(ctx, sqlite.AuthInput{
+			UserName: "test",
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !output.OK {
+			t.Fatal("expected login to succeed")
+		}
+		user, err := db.Queries.GetUserByUsername(ctx, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Password
+	}
+
+	svc := sqlite.NewAuthService(db, sqlite.AuthConfig{PasswordHasher: sqlite.BcryptHasher{Cost: 4}})
+	_, err = svc.Signup(ctx, sqlite.AuthInput{
+		UserName: "test",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	old := login(sqlite.BcryptHasher{Cost: 4})
+
+	// a higher cost upgrades the hash, a lower one leaves it alone
+	upgraded := login(sqlite.BcryptHasher{Cost: 5})
+	if bytes.Equal(upgraded, old) || !strings.HasPrefix(string(upgraded), "$2a$05$") {
+		t.Fatalf("expected a cost 5 bcrypt hash, got %s", upgraded)
+	}
+	if hash := login(sqlite.BcryptHasher{Cost: 4}); !bytes.Equal(hash, upgraded) {
+		t.Fatalf("expected the hash to be kept, got %s", hash)
+	}
+
+	argon2id := sqlite.Argon2idHasher{
+		Memory:      1024,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+	hash := login(argon2id)
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("expected an argon2id hash, got %s", hash)
+	}
+	if again := login(argon2id); !bytes.Equal(again, hash) {
+		t.Fatalf("expected the hash to be kept, got %s", again)
+	}
+	argon2id.Iterations = 2
+	hash = login(argon2id)
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=1024,t=2,p=1$") {
+		t.Fatalf("expected more iterations to rehash, got %s", hash)
+	}
+	// switching back to bcrypt doesn't downgrade the hash
+	if again := login(sqlite.BcryptHasher{Cost: 4}); !bytes.Equal(again, hash) {
+		t.Fatalf("expected the argon2id hash to be kept, got %s", again)
+	}
+}
+
+func TestParsePasswordHasher(t *testing.T) {
+	hasher, err := sqlite.ParsePasswordHasher("", "12")
+	if err != nil || hasher != (sqlite.BcryptHasher{Cost: 12}) {
+		t.Fatalf("expected bcrypt at cost 12, got %v, %v", hasher, err)
+	}
+	if hasher, err := sqlite.ParsePasswordHasher("argon2id", ""); err != nil || hasher != sqlite.DefaultArgon2idHasher {
+		t.Fatalf("expected the default argon2id hasher, got %v, %v", hasher, err)
+	}
+	if _, err := sqlite.ParsePasswordHasher("md5", ""); err == nil {
+		t.Fatal("expected the scheme to be checked")
+	}
+	for _, cost := range []string{"high", "3", "32"} {
+		if _, err := sqlite.ParsePasswordHasher("bcrypt", cost); err == nil {
+			t.Fatalf("expected cost %s to be refused", cost)
+		}
+	}
+}
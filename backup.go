@@ -0,0 +1,459 @@
+package sqlite
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// DefaultKeepBackups is how many backups are kept when BackupConfig.Keep is
+// zero.
+const DefaultKeepBackups = 10
+
+type BackupConfig struct {
+	// Dir is where backups are written, a backups directory next to the
+	// database file by default.
+	Dir string
+	// Keep is how many of the newest backups to keep, older ones are
+	// deleted. Zero means DefaultKeepBackups, a negative number keeps all.
+	Keep int
+}
+
+// Backup writes a consistent snapshot of the database to path, which must
+// not exist yet. It's safe to call while the database is in use.
+func (db *DB) Backup(ctx context.Context, path string) error {
+	// on a read connection, so writers carry on, which query_only would
+	// stop from writing the copy
+	conn, err := db.read.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if db.read != db.db {
+		// the connection is thrown away after rather than trusted to be
+		// query only again, it would let readers write
+		defer conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+		if _, err := conn.ExecContext(ctx, `pragma query_only = off`); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.ExecContext(ctx, `vacuum into ?`, path); err != nil {
+		return fmt.Errorf("cannot back up db to %s: %w", path, err)
+	}
+	return nil
+}
+
+// OnlineBackup copies the database to path with SQLite's online backup API.
+// Unlike Backup the copy is page for page, it isn't vacuumed.
+func (db *DB) OnlineBackup(ctx context.Context, path string) error {
+	conn, err := db.read.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return onlineBackup(ctx, conn, path)
+}
+
+// onlineBackup copies the database of src to path in one step. A copy made a
+// few pages at a time starts over whenever someone writes, under a steady
+// load it would never finish, while one step is a single read transaction,
+// which writers don't wait for in WAL mode. If src is in a read transaction
+// already the copy is of what that transaction sees.
+func onlineBackup(ctx context.Context, src *sql.Conn, path string) error {
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	return destConn.Raw(func(destRaw interface{}) error {
+		return src.Raw(func(srcRaw interface{}) error {
+			// the destination is opened by the plain driver, the source
+			// comes from one of our pools
+			backup, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(countedConn).SQLiteConn, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// file returns the path of the main database file, or an empty string for
+// in-memory databases.
+func (db *DB) file(ctx context.Context) (string, error) {
+	var file string
+	err := db.read.QueryRowContext(ctx, `select file from pragma_database_list where name = 'main'`).Scan(&file)
+	return file, err
+}
+
+// backupTarget returns the directory backups of the database go to and the
+// prefix of their names, or empty strings for in-memory databases.
+func (db *DB) backupTarget(ctx context.Context, dir string) (string, string, error) {
+	file, err := db.file(ctx)
+	if err != nil || file == "" {
+		return "", "", err
+	}
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(file), "backups")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", fmt.Errorf("cannot create backup directory: %w", err)
+	}
+	return dir, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)) + "-", nil
+}
+
+// newBackupPath names a backup after the time it was taken, which sorts
+// backups oldest first by name.
+func newBackupPath(dir, prefix string) string {
+	return filepath.Join(dir, prefix+time.Now().UTC().Format("20060102T150405.000000000Z")+".db")
+}
+
+// snapshotPrefix tells snapshots apart from scheduled backups in the same
+// directory, so neither is pruned to make room for the other.
+const snapshotPrefix = "snapshot-"
+
+// Snapshot backs the database up to a timestamped file in the backup
+// directory and deletes the snapshots beyond those it keeps. It's what's
+// taken before migrating, and it's named apart from the scheduled backups so
+// they never prune it. It returns the path of the new backup, or an empty
+// string for in-memory databases, which have nothing worth keeping.
+func (db *DB) Snapshot(ctx context.Context, config BackupConfig) (string, error) {
+	dir, prefix, err := db.backupTarget(ctx, config.Dir)
+	if err != nil || dir == "" {
+		return "", err
+	}
+	prefix += snapshotPrefix
+	path := newBackupPath(dir, prefix)
+	if err := db.Backup(ctx, path); err != nil {
+		return "", err
+	}
+	return path, pruneBackups(dir, prefix, config.Keep)
+}
+
+func pruneBackups(dir, prefix string, keep int) error {
+	if keep == 0 {
+		keep = DefaultKeepBackups
+	}
+	if keep < 0 {
+		return nil
+	}
+	backups, err := ListBackups(dir, prefix)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("cannot delete old backup: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// ListBackups returns the backups in dir whose names are prefix followed by
+// the time they were taken, oldest first. Backups are .db files, or .db.gz
+// when compressed. Snapshots have a prefix of their own, see Snapshot.
+func ListBackups(dir, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// the time comes right after the prefix, a letter is a longer
+		// prefix like the one of snapshots
+		rest := strings.TrimPrefix(name, prefix)
+		timestamped := strings.HasPrefix(name, prefix) && rest != "" && rest[0] >= '0' && rest[0] <= '9'
+		if !entry.IsDir() && timestamped && (strings.HasSuffix(name, ".db") || strings.HasSuffix(name, ".db.gz")) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// RestoreBackup replaces the database file at path with a copy of backup,
+// after checking the copy is intact. Compressed backups are decompressed.
+// Nothing may have the database open while it's restored, its write-ahead
+// log is discarded.
+func RestoreBackup(ctx context.Context, backup, path string) error {
+	src, err := os.Open(backup)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var r io.Reader = src
+	if strings.HasSuffix(backup, ".gz") {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return fmt.Errorf("cannot decompress %s: %w", backup, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	// copy next to the database first so the swap is a single rename
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := checkIntegrity(ctx, tmp.Name()); err != nil {
+		return err
+	}
+	// the log belongs to the database being replaced, replaying it onto the
+	// backup would corrupt it
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("cannot restore backup: %w", err)
+	}
+	return nil
+}
+
+func checkIntegrity(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	// relative paths would be read as the host of the URI, and characters
+	// like ? and # in the path have to be escaped
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	dsn := url.URL{Scheme: "file", Path: abs, RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite3", dsn.String())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRowContext(ctx, `pragma integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("cannot check %s: %w", path, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%s is corrupt: %s", path, result)
+	}
+	return nil
+}
+
+// compressBackup gzips the backup at path and removes the original.
+func compressBackup(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dest, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(dest)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = dest.Sync()
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return "", err
+	}
+	return path + ".gz", os.Remove(path)
+}
+
+// ErrBackupNotFound is returned for backups that don't exist or aren't in
+// the backup directory.
+var ErrBackupNotFound = errors.New("backup not found")
+
+type BackupServiceConfig struct {
+	BackupConfig
+	// Interval is how often Run takes a backup, zero disables scheduled
+	// backups.
+	Interval time.Duration
+	// Compress gzips backups once they are verified.
+	Compress bool
+}
+
+// BackupService takes verified backups of the running database, on a
+// schedule and on demand.
+type BackupService struct {
+	db     *DB
+	config BackupServiceConfig
+	// mu makes sure only one backup runs at a time
+	mu sync.Mutex
+}
+
+func NewBackupService(db *DB, config BackupServiceConfig) *BackupService {
+	return &BackupService{
+		db:     db,
+		config: config,
+	}
+}
+
+// Run takes a backup every interval until ctx is done. Failures are logged
+// and counted, the next backup is tried as scheduled.
+func (svc *BackupService) Run(ctx context.Context) {
+	if svc.config.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(svc.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			svc.Backup(ctx)
+		}
+	}
+}
+
+// Backup takes a backup now and returns its path. The backup is checked for
+// integrity before it's kept, a corrupt one is deleted.
+func (svc *BackupService) Backup(ctx context.Context) (string, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	start := time.Now()
+	path, err := svc.backup(ctx)
+	backupDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		backupsTotal.WithLabelValues("failed").Inc()
+		slog.ErrorContext(ctx, "backup failed", "err", err)
+		return "", err
+	}
+	backupsTotal.WithLabelValues("ok").Inc()
+	backupLastSuccess.SetToCurrentTime()
+	if info, err := os.Stat(path); err == nil {
+		backupSize.Set(float64(info.Size()))
+	}
+	slog.InfoContext(ctx, "backed up", "path", path, "duration", time.Since(start).Round(time.Millisecond))
+	return path, nil
+}
+
+func (svc *BackupService) backup(ctx context.Context) (string, error) {
+	dir, prefix, err := svc.db.backupTarget(ctx, svc.config.Dir)
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		return "", errors.New("in-memory databases can't be backed up")
+	}
+	path := newBackupPath(dir, prefix)
+	// the backup isn't listed until it's verified
+	tmp := path + ".tmp"
+	if err := svc.db.OnlineBackup(ctx, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := checkIntegrity(ctx, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if svc.config.Compress {
+		if path, err = compressBackup(path); err != nil {
+			return "", err
+		}
+	}
+	return path, pruneBackups(dir, prefix, svc.config.Keep)
+}
+
+type BackupInfo struct {
+	Name      string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// List returns the backups that are kept, newest first.
+func (svc *BackupService) List(ctx context.Context) ([]BackupInfo, error) {
+	dir, prefix, err := svc.db.backupTarget(ctx, svc.config.Dir)
+	if err != nil || dir == "" {
+		return nil, err
+	}
+	paths, err := ListBackups(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]BackupInfo, 0, len(paths))
+	for i := len(paths) - 1; i >= 0; i-- {
+		info, err := os.Stat(paths[i])
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, BackupInfo{
+			Name:      info.Name(),
+			Size:      info.Size(),
+			CreatedAt: info.ModTime(),
+		})
+	}
+	return backups, nil
+}
+
+// Open opens a kept backup by name for download.
+func (svc *BackupService) Open(ctx context.Context, name string) (*os.File, error) {
+	backups, err := svc.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// only names from the list are opened, never paths from the request
+	for _, backup := range backups {
+		if backup.Name == name {
+			dir, _, err := svc.db.backupTarget(ctx, svc.config.Dir)
+			if err != nil {
+				return nil, err
+			}
+			return os.Open(filepath.Join(dir, name))
+		}
+	}
+	return nil, ErrBackupNotFound
+}
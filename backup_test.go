@@ -0,0 +1,305 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sqlite"
+	"sqlite/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dsn := filepath.Join(dir, "app.db")
+	backupDir := filepath.Join(dir, "backups")
+	db, err := sqlite.CreateAndMigrateDb(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	backups := func() []string {
+		backups, err := sqlite.ListBackups(backupDir, "app-snapshot-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backups
+	}
+	signup := func(userName string) {
+		_, err := sqlite.NewAuthService(db, sqlite.AuthConfig{}).Signup(ctx, sqlite.AuthInput{
+			UserName: userName,
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a brand-new database has nothing to back up
+	if len(backups()) != 0 {
+		t.Fatalf("expected no backup of a new database, got %v", backups())
+	}
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if err := db.Rollback(ctx, statuses[len(statuses)-2].Version); err != nil {
+		t.Fatal(err)
+		return
+	}
+	// an existing one is backed up before it's migrated
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(backups()) != 1 {
+		t.Fatalf("expected a backup before migrating, got %v", backups())
+	}
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(backups()) != 1 {
+		t.Fatalf("expected no backup without pending migrations, got %v", backups())
+	}
+
+	signup("alice")
+	alice := filepath.Join(dir, "alice.db")
+	if err := db.Backup(ctx, alice); err != nil {
+		t.Fatal(err)
+		return
+	}
+	// the read connection the backup wrote with isn't handed out again
+	for i := 0; i < 8; i++ {
+		if _, err := db.ReadQueries.CreateUser(ctx, model.CreateUserParams{UserName: "eve", Password: []byte("eve")}); err == nil {
+			t.Fatal("expected read connections to stay query only")
+		}
+	}
+	signup("bob")
+	first, err := db.Snapshot(ctx, sqlite.BackupConfig{Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.Snapshot(ctx, sqlite.BackupConfig{Keep: 2}); err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	if list := backups(); len(list) != 2 || list[0] == first {
+		t.Fatalf("expected only the newest 2 backups to be kept, got %v", list)
+	}
+	// scheduled backups to the same directory leave the snapshots alone
+	svc := sqlite.NewBackupService(db, sqlite.BackupServiceConfig{BackupConfig: sqlite.BackupConfig{Keep: 1}})
+	for i := 0; i < 2; i++ {
+		if _, err := svc.Backup(ctx); err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	if scheduled, err := svc.List(ctx); err != nil || len(scheduled) != 1 {
+		t.Fatalf("expected only the newest scheduled backup to be kept, got %v %v", scheduled, err)
+	}
+	if list := backups(); len(list) != 2 {
+		t.Fatalf("expected the snapshots to be kept, got %v", list)
+	}
+
+	junk := filepath.Join(dir, "junk.db")
+	if err := os.WriteFile(junk, []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+		return
+	}
+	db.Close()
+	if err := sqlite.RestoreBackup(ctx, junk, dsn); err == nil {
+		t.Fatal("expected restoring a corrupt backup to fail")
+	}
+	if err := sqlite.RestoreBackup(ctx, alice, dsn); err != nil {
+		t.Fatal(err)
+		return
+	}
+	db, err = sqlite.OpenDb(ctx, dsn, sqlite.DBConfig{})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	if _, err := db.Queries.GetUserByUsername(ctx, "alice"); err != nil {
+		t.Fatalf("expected alice to be restored, got %v", err)
+	}
+	if _, err := db.Queries.GetUserByUsername(ctx, "bob"); err != sql.ErrNoRows {
+		t.Fatalf("expected bob to be gone, got %v", err)
+	}
+
+	memory, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer memory.Close()
+	if path, err := memory.Snapshot(ctx, sqlite.BackupConfig{Dir: backupDir}); err != nil || path != "" {
+		t.Fatalf("expected in-memory databases to not be backed up, got %q %v", path, err)
+	}
+}
+
+func TestBackupService(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(dir, "app.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	_, err = sqlite.NewAuthService(db, sqlite.AuthConfig{}).Signup(ctx, sqlite.AuthInput{
+		UserName: "alice",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	svc := sqlite.NewBackupService(db, sqlite.BackupServiceConfig{
+		BackupConfig: sqlite.BackupConfig{Dir: filepath.Join(dir, "online"), Keep: 2},
+		Interval:     10 * time.Millisecond,
+		Compress:     true,
+	})
+
+	// the scheduled backups keep going until they are stopped
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		svc.Run(runCtx)
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		backups, err := svc.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		if len(backups) == 2 {
+			break
+		}
+		if i == 200 {
+			t.Fatal("expected scheduled backups")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	<-done
+
+	path, err := svc.Backup(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	backups, err := svc.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(backups) != 2 || backups[0].Name != filepath.Base(path) || !strings.HasSuffix(path, ".db.gz") {
+		t.Fatalf("expected the 2 newest compressed backups, newest first, got %+v", backups)
+	}
+
+	if _, err := svc.Open(ctx, "../app.db"); err != sqlite.ErrBackupNotFound {
+		t.Fatalf("expected only backups to be opened, got %v", err)
+	}
+	file, err := svc.Open(ctx, backups[0].Name)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	file.Close()
+
+	// a compressed backup restores to a working database
+	restored := filepath.Join(dir, "restored.db")
+	if err := sqlite.RestoreBackup(ctx, path, restored); err != nil {
+		t.Fatal(err)
+		return
+	}
+	db, err = sqlite.OpenDb(ctx, restored, sqlite.DBConfig{})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	if _, err := db.Queries.GetUserByUsername(ctx, "alice"); err != nil {
+		t.Fatalf("expected alice in the backup, got %v", err)
+	}
+}
+
+func TestOnlineBackupUnderWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(dir, "app.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	// more pages than would be copied in a step or two
+	err = db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		for i := 0; i < 2000; i++ {
+			name := fmt.Sprintf("user%d", i)
+			_, err := q.CreateUser(ctx, model.CreateUserParams{UserName: name, UserNameSkeleton: name, Password: make([]byte, 4000)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	// someone keeps writing while the backup runs
+	stop := make(chan struct{})
+	writing := make(chan struct{})
+	go func() {
+		defer close(writing)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			name := fmt.Sprintf("writer%d", i)
+			db.Queries.CreateUser(ctx, model.CreateUserParams{UserName: name, UserNameSkeleton: name, Password: []byte("foo")})
+		}
+	}()
+	done := make(chan error, 1)
+	path := filepath.Join(dir, "online.db")
+	go func() {
+		done <- db.OnlineBackup(ctx, path)
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the backup to finish while writes go on")
+	}
+	close(stop)
+	<-writing
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	backup, err := sqlite.OpenDb(ctx, path, sqlite.DBConfig{})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer backup.Close()
+	if _, err := backup.Queries.GetUserByUsername(ctx, "user1999"); err != nil {
+		t.Fatalf("expected the users in the backup, got %v", err)
+	}
+}
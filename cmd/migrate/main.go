@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sqlite"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: migrate [flags] <command>
+
+commands:
+  status            list applied, pending, changed and missing migrations
+  up                apply every pending migration
+  rollback VERSION  revert every migration newer than VERSION, 0 reverts all
+  backup            back the database up now
+  backups           list backups and snapshots, oldest first
+  restore BACKUP    replace the database with BACKUP, stop the server first
+  vacuum            rebuild the database, which turns incremental vacuuming on
+                    for databases from before it was the default
+  restore-replica [TIME]
+                    replace the database with the one in the -replica, as it
+                    was at TIME (RFC 3339) or as recent as possible
+
+up and rollback back the database up before changing it. Restoring backs the
+database it replaces up too, so a restore can be undone by restoring again.
+-replica is a directory or s3://bucket/prefix, with S3 configured by the usual
+AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_REGION and AWS_ENDPOINT_URL.
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func run() error {
+	dsn := flag.String("db", "db/app.db", "the database to migrate")
+	warnOnDrift := flag.Bool("warn-drift", false, "migrate even if applied migrations changed or are missing")
+	backupDir := flag.String("backup-dir", "", "where backups go, a backups directory next to the database by default")
+	keepBackups := flag.Int("keep-backups", sqlite.DefaultKeepBackups, "how many backups to keep, -1 keeps all")
+	noBackup := flag.Bool("no-backup", false, "don't back up before migrating or rolling back")
+	replica := flag.String("replica", "", "where the server replicates to, for restore-replica")
+	pragmaFlag := flag.String("pragmas", "", "`pragmas` like cache_size=-20000,foreign_keys=off set on every connection")
+	flag.Usage = usage
+	flag.Parse()
+
+	ctx := context.Background()
+	pragmas, err := sqlite.ParsePragmas(*pragmaFlag)
+	if err != nil {
+		return err
+	}
+	db, err := sqlite.OpenDb(ctx, *dsn, sqlite.DBConfig{Pragmas: pragmas})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	backup := sqlite.BackupConfig{Dir: *backupDir, Keep: *keepBackups}
+	if backup.Dir == "" {
+		backup.Dir = filepath.Join(filepath.Dir(*dsn), "backups")
+	}
+	snapshot := func() error {
+		path, err := db.Snapshot(ctx, backup)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("backed up to %s\n", path)
+		return nil
+	}
+
+	switch flag.Arg(0) {
+	case "status":
+		statuses, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSTATUS\tAPPLIED AT\tDOWN\tNAME")
+		for _, status := range statuses {
+			state, appliedAt, down := "pending", "", "no"
+			switch {
+			case status.Missing:
+				state = "missing"
+			case status.Changed:
+				state = "changed"
+			case status.Applied:
+				state = "applied"
+			}
+			if !status.AppliedAt.IsZero() {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.Reversible {
+				down = "yes"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", status.Version, state, appliedAt, down, status.Name)
+		}
+		return w.Flush()
+	case "up":
+		return db.Migrate(ctx, sqlite.MigrateConfig{
+			WarnOnDrift: *warnOnDrift,
+			Backup:      backup,
+			SkipBackup:  *noBackup,
+		})
+	case "rollback":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if !*noBackup {
+			if err := snapshot(); err != nil {
+				return err
+			}
+		}
+		return db.Rollback(ctx, flag.Arg(1))
+	case "backup":
+		return snapshot()
+	case "vacuum":
+		before, err := db.Size(ctx)
+		if err != nil {
+			return err
+		}
+		if err := db.Vacuum(ctx); err != nil {
+			return err
+		}
+		after, err := db.Size(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("vacuumed %s from %d to %d bytes\n", *dsn, before, after)
+	case "backups":
+		prefix := strings.TrimSuffix(filepath.Base(*dsn), filepath.Ext(*dsn)) + "-"
+		backups, err := sqlite.ListBackups(backup.Dir, prefix)
+		if err != nil {
+			return err
+		}
+		snapshots, err := sqlite.ListBackups(backup.Dir, prefix+"snapshot-")
+		if err != nil {
+			return err
+		}
+		// both are named after the time they were taken
+		taken := func(path string) string {
+			return strings.TrimPrefix(strings.TrimPrefix(filepath.Base(path), prefix), "snapshot-")
+		}
+		backups = append(backups, snapshots...)
+		sort.Slice(backups, func(i, j int) bool { return taken(backups[i]) < taken(backups[j]) })
+		for _, path := range backups {
+			fmt.Println(path)
+		}
+	case "restore":
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := snapshot(); err != nil {
+			return err
+		}
+		// the database has to be closed before its file is replaced
+		db.Close()
+		if err := sqlite.RestoreBackup(ctx, flag.Arg(1), *dsn); err != nil {
+			return err
+		}
+		fmt.Printf("restored %s from %s\n", *dsn, flag.Arg(1))
+	case "restore-replica":
+		if *replica == "" || flag.NArg() > 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		target, err := sqlite.ParseReplicaTarget(*replica)
+		if err != nil {
+			return err
+		}
+		var at time.Time
+		if flag.NArg() == 2 {
+			if at, err = time.Parse(time.RFC3339, flag.Arg(1)); err != nil {
+				return err
+			}
+		}
+		if err := snapshot(); err != nil {
+			return err
+		}
+		db.Close()
+		if err := sqlite.RestoreReplica(ctx, target, *dsn, at); err != nil {
+			return err
+		}
+		fmt.Printf("restored %s from %s\n", *dsn, *replica)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,30 +15,178 @@ import (
 
 	_ "net/http/pprof"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 func run() error {
+	admin := flag.String("admin", "", "make an existing `user` an instance admin before serving")
+	flag.Parse()
+
+	// LOG_FORMAT is text or json and LOG_LEVEL debug, info, warn or error,
+	// the log package is sent through the same logger
+	logConfig, err := sqlite.ParseLogConfig(os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(sqlite.NewLogger(os.Stderr, logConfig))
+
 	ctx := context.Background()
-	db, err := sqlite.CreateAndMigrateDb(ctx, "db/app.db")
+	// DB_PRAGMAS like "cache_size=-20000,mmap_size=268435456" are set on
+	// every connection on top of the defaults
+	pragmas, err := sqlite.ParsePragmas(os.Getenv("DB_PRAGMAS"))
+	if err != nil {
+		return err
+	}
+	dbConfig := sqlite.DBConfig{Pragmas: pragmas}
+	// queries slower than SLOW_QUERY are logged with their plan, -1s logs none
+	if slowQuery := os.Getenv("SLOW_QUERY"); slowQuery != "" {
+		if dbConfig.SlowQuery, err = time.ParseDuration(slowQuery); err != nil {
+			return fmt.Errorf("invalid SLOW_QUERY: %w", err)
+		}
+	}
+	db, err := sqlite.OpenDb(ctx, "db/app.db", dbConfig)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
+	// edited or missing migrations stop the server unless told otherwise
+	err = db.Migrate(ctx, sqlite.MigrateConfig{
+		WarnOnDrift: os.Getenv("MIGRATION_DRIFT") == "warn",
+	})
+	if err != nil {
+		return err
+	}
+
+	// backups run in the background until the server shuts down, every
+	// six hours unless BACKUP_INTERVAL says otherwise, 0 turns them off
+	backupConfig := sqlite.BackupServiceConfig{
+		Interval: 6 * time.Hour,
+		Compress: os.Getenv("BACKUP_COMPRESS") == "true",
+	}
+	if interval := os.Getenv("BACKUP_INTERVAL"); interval != "" {
+		if backupConfig.Interval, err = time.ParseDuration(interval); err != nil {
+			return fmt.Errorf("invalid BACKUP_INTERVAL: %w", err)
+		}
+	}
+	backupService := sqlite.NewBackupService(db, backupConfig)
+	backupCtx, stopBackups := context.WithCancel(ctx)
+	defer stopBackups()
+	go backupService.Run(backupCtx)
+
+	// REPLICA is a directory or s3://bucket/prefix to ship the WAL to, the
+	// last of it is shipped before the database is closed
+	location := os.Getenv("REPLICA")
+	if location != "" {
+		target, err := sqlite.ParseReplicaTarget(location)
+		if err != nil {
+			return err
+		}
+		replicator := sqlite.NewReplicator(db, sqlite.ReplicationConfig{Target: target})
+		replicaCtx, stopReplication := context.WithCancel(ctx)
+		replicaDone := make(chan struct{})
+		go func() {
+			replicator.Run(replicaCtx)
+			close(replicaDone)
+		}()
+		defer func() {
+			stopReplication()
+			<-replicaDone
+		}()
+	}
 
-	authService := sqlite.NewAuthService(db)
+	adminService := sqlite.NewAdminService(db)
+	if *admin != "" {
+		if err := adminService.GrantAdmin(ctx, *admin); err != nil {
+			return err
+		}
+	}
+
+	// PASSWORD_HASH is bcrypt or argon2id and BCRYPT_COST the cost of
+	// bcrypt hashes, existing hashes keep working and are upgraded as users
+	// log in
+	hasher, err := sqlite.ParsePasswordHasher(os.Getenv("PASSWORD_HASH"), os.Getenv("BCRYPT_COST"))
+	if err != nil {
+		return err
+	}
+	authService := sqlite.NewAuthService(db, sqlite.AuthConfig{PasswordHasher: hasher})
 	userService := sqlite.NewUserService(db)
 	dialService := sqlite.NewDialService(db)
+
+	// maintenance and cleanup run in the background, runs in progress are
+	// waited for before the database is closed
+	scheduler := sqlite.NewScheduler(db)
+	jobs := sqlite.MaintenanceJobs(db, sqlite.MaintenanceConfig{SkipCheckpoint: location != ""})
+	jobs = append(jobs, sqlite.Job{
+		Name:     "purge-expired",
+		Schedule: "*/10 * * * *",
+		Jitter:   time.Minute,
+		Run:      authService.PurgeExpired,
+	})
+	for _, job := range jobs {
+		if err := scheduler.Register(job); err != nil {
+			return err
+		}
+	}
+	schedulerCtx, stopScheduler := context.WithCancel(ctx)
+	schedulerDone := make(chan struct{})
+	go func() {
+		scheduler.Run(schedulerCtx)
+		close(schedulerDone)
+	}()
+	defer func() {
+		stopScheduler()
+		<-schedulerDone
+	}()
 	var server *http.Server
 
 	env := os.Getenv("ENV")
 
+	host, origin := "localhost", "http://localhost:8000"
+	if env == "prod" {
+		host, origin = "silva.world", "https://silva.world"
+	}
+	webAuthnService, err := sqlite.NewWebAuthnService(db, sqlite.WebAuthnConfig{
+		RPID:          host,
+		RPDisplayName: "Dials",
+		RPOrigins:     []string{origin},
+	})
+	if err != nil {
+		return err
+	}
+
+	// single sign-on is only enabled when an issuer is configured
+	var oidcService *sqlite.OIDCService
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		oidcService, err = sqlite.NewOIDCService(ctx, db, sqlite.OIDCConfig{
+			Issuer:        issuer,
+			ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   origin + "/login/oidc/callback",
+			UsernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+			Team:          os.Getenv("OIDC_TEAM"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// without a relay emails are written to disk for development
+	var mailer sqlite.Mailer = sqlite.FileMailer{Dir: "mail", From: "dials@" + host}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		mailer = sqlite.SMTPMailer{Addr: addr, From: os.Getenv("SMTP_FROM")}
+	}
+	emailService := sqlite.NewEmailService(db, sqlite.EmailConfig{
+		Mailer:  mailer,
+		BaseURL: origin,
+	})
+
 	if env == "prod" {
 		certManager := autocert.Manager{
 			Cache:      autocert.DirCache("certs"),
 			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist("silva.world"),
+			HostPolicy: autocert.HostWhitelist(host),
 		}
 
 		server = &http.Server{
@@ -43,22 +194,23 @@ func run() error {
 			TLSConfig: &tls.Config{
 				GetCertificate: certManager.GetCertificate,
 			},
-			Handler: sqlite.NewHandler(authService, userService, dialService, true),
+			Handler: sqlite.NewHandler(authService, userService, dialService, webAuthnService, oidcService, emailService, adminService, backupService, true),
 		}
 		go func() { http.ListenAndServe(":80", certManager.HTTPHandler(nil)) }()
 		go func() { log.Fatal(server.ListenAndServeTLS("", "")) }()
-		log.Println("server running on ports 80 and 443")
+		slog.Info("server running", "ports", []int{80, 443})
 	} else {
 
 		server = &http.Server{
 			Addr:    ":8000",
-			Handler: sqlite.NewHandler(authService, userService, dialService, false),
+			Handler: sqlite.NewHandler(authService, userService, dialService, webAuthnService, oidcService, emailService, adminService, backupService, false),
 		}
 
 		go func() { log.Fatal(server.ListenAndServe()) }()
-		log.Println("server running on port 8000")
+		slog.Info("server running", "port", 8000)
 	}
 
+	prometheus.MustRegister(sqlite.NewDBCollector(db, 0))
 	http.Handle("/metrics", promhttp.Handler())
 	go func() { log.Fatal(http.ListenAndServe(":6060", nil)) }()
 
@@ -0,0 +1,68 @@
+package sqlite
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"sqlite/templates"
+)
+
+const csrfCookie = "csrf"
+
+// csrfMiddleware protects every state changing request with a double submit
+// token. The token lives in a cookie for the browser session and must be
+// echoed back in the csrf_token form field or the X-CSRF-Token header, which
+// another site can't do since it can't read the cookie.
+func (h *Handler) csrfMiddleware(handle http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		default:
+			submitted := r.Header.Get("X-CSRF-Token")
+			if submitted == "" {
+				submitted = r.PostFormValue("csrf_token")
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) != 1 {
+				w.WriteHeader(http.StatusForbidden)
+				templates.Forbidden(UserFromFromContext(r.Context()).UserID != 0).Render(r.Context(), w)
+				return
+			}
+		}
+
+		if token == "" {
+			var err error
+			if token, err = newCSRFToken(); err != nil {
+				handleError(w, r, err)
+				return
+			}
+			h.setCSRFCookie(w, token)
+		}
+		r = r.WithContext(templates.WithCSRFToken(r.Context(), token))
+		handle.ServeHTTP(w, r)
+	})
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (h *Handler) setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   h.UseTLS,
+	})
+}
@@ -0,0 +1,142 @@
+package sqlite_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sqlite"
+	"strings"
+	"testing"
+)
+
+// newTestServer serves the full handler over a fresh in-memory database.
+func newTestServer(t *testing.T) *httptest.Server {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webAuthnService, err := sqlite.NewWebAuthnService(db, sqlite.WebAuthnConfig{
+		RPID:          "localhost",
+		RPDisplayName: "Dials",
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(sqlite.NewHandler(
+		sqlite.NewAuthService(db, sqlite.AuthConfig{}),
+		sqlite.NewUserService(db),
+		sqlite.NewDialService(db),
+		webAuthnService,
+		nil,
+		sqlite.NewEmailService(db, sqlite.EmailConfig{
+			Mailer:  sqlite.FileMailer{Dir: t.TempDir()},
+			BaseURL: testOrigin,
+		}),
+		sqlite.NewAdminService(db),
+		sqlite.NewBackupService(db, sqlite.BackupServiceConfig{}),
+		false,
+	))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCSRF(t *testing.T) {
+	server := newTestServer(t)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	post := func(path string, form url.Values) int {
+		res, err := client.PostForm(server.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// the first page view hands out the token
+	res, err := client.Get(server.URL + "/signup")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	res.Body.Close()
+	serverURL, _ := url.Parse(server.URL)
+	csrfCookie := func() string {
+		for _, cookie := range jar.Cookies(serverURL) {
+			if cookie.Name == "csrf" {
+				return cookie.Value
+			}
+		}
+		return ""
+	}
+	token := csrfCookie()
+	if token == "" {
+		t.Fatal("expected a csrf cookie")
+	}
+
+	signup := url.Values{"userName": {"test"}, "password": {testPassword}}
+	if status := post("/signup", signup); status != http.StatusForbidden {
+		t.Fatalf("expected status 403 without a token, got %d", status)
+	}
+	signup.Set("csrf_token", "wrong")
+	if status := post("/signup", signup); status != http.StatusForbidden {
+		t.Fatalf("expected status 403 with the wrong token, got %d", status)
+	}
+	signup.Set("csrf_token", token)
+	if status := post("/signup", signup); status != http.StatusFound {
+		t.Fatalf("expected status 302, got %d", status)
+	}
+
+	// logging in hands out a new token, the one from before is no use
+	stale := token
+	if token = csrfCookie(); token == "" || token == stale {
+		t.Fatalf("expected a new csrf cookie, got %q", token)
+	}
+	if status := post("/newDial", url.Values{"name": {"test"}, "csrf_token": {stale}}); status != http.StatusForbidden {
+		t.Fatalf("expected status 403 with the token from before login, got %d", status)
+	}
+
+	if status := post("/newDial", url.Values{"name": {"test"}}); status != http.StatusForbidden {
+		t.Fatalf("expected status 403 without a token, got %d", status)
+	}
+	if status := post("/newDial", url.Values{"name": {"test"}, "csrf_token": {token}}); status != http.StatusFound {
+		t.Fatalf("expected status 302, got %d", status)
+	}
+
+	// the json api takes the token from a header
+	patch := func(token string) int {
+		req, err := http.NewRequest(http.MethodPatch, server.URL+"/dials/1", strings.NewReader(`{"value":5}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("X-CSRF-Token", token)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if status := patch(""); status != http.StatusForbidden {
+		t.Fatalf("expected status 403 without a token, got %d", status)
+	}
+	if status := patch(token); status != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+}
@@ -3,123 +3,515 @@ package sqlite
 import (
 	"context"
 	"database/sql"
-	"embed"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-	"io/fs"
+	"math/rand"
+	"runtime"
 	"sort"
 	"sqlite/model"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
-//go:embed db/migrations/*.sql
-var migrationFS embed.FS
-
+// DB has a pool of one connection for writing, so writers queue in Go
+// rather than spinning on busy_timeout, and a pool of read-only connections
+// that WAL mode lets read alongside it.
 type DB struct {
+	// Queries writes, and reads what has to be current within a write.
 	Queries *model.Queries
-	db      *sql.DB
+	// ReadQueries only reads, without waiting for writers.
+	ReadQueries *model.Queries
+	db          *sql.DB
+	read        *sql.DB
+	retry       RetryConfig
+	slowQuery   time.Duration
+	// explains holds a slot for every slow query being explained
+	explains chan struct{}
+
+	mu             sync.Mutex
+	lastCheckpoint CheckpointResult
+}
+
+// maxExplains is how many slow queries are explained at once, the rest are
+// logged without their plan.
+const maxExplains = 2
+
+// DefaultPragmas are set on every connection unless DBConfig.Pragmas says
+// otherwise.
+var DefaultPragmas = map[string]string{
+	"busy_timeout": "5000",
+	"foreign_keys": "on",
+	"synchronous":  "normal",
+}
+
+// DBConfig configures how the database is opened.
+type DBConfig struct {
+	// Pragmas are set on every connection as it's opened, on top of
+	// DefaultPragmas. An empty value leaves a default one unset.
+	Pragmas map[string]string
+	// Retry is how transactions are retried when the database is busy.
+	Retry RetryConfig
+	// SlowQuery is how long a query takes before it's logged with its plan,
+	// 100ms by default. A negative duration logs none.
+	SlowQuery time.Duration
+}
+
+// RetryConfig is how often and how long apart a transaction that failed
+// because the database was busy or locked is tried again. Zero values are
+// replaced by the defaults.
+type RetryConfig struct {
+	// Attempts is how many times a transaction is tried at most, 5 by
+	// default. 1 turns retrying off.
+	Attempts int
+	// Backoff is how long to wait before the first retry, 10ms by default,
+	// doubling for every retry after. Each wait is jittered by up to half.
+	Backoff time.Duration
+	// MaxBackoff is the longest wait between attempts, 1s by default.
+	MaxBackoff time.Duration
+}
+
+func (config RetryConfig) withDefaults() RetryConfig {
+	if config.Attempts <= 0 {
+		config.Attempts = 5
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = 10 * time.Millisecond
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = time.Second
+	}
+	return config
+}
+
+// backoff returns how long to wait before the given retry, the first is 1.
+func (config RetryConfig) backoff(retry int) time.Duration {
+	wait := config.Backoff << (retry - 1)
+	if wait > config.MaxBackoff || wait <= 0 {
+		wait = config.MaxBackoff
+	}
+	// waiters that collided shouldn't all come back at once
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// pragmas returns the statements setting up a connection, in a stable order.
+func (config DBConfig) pragmas() ([]string, error) {
+	merged := map[string]string{}
+	for name, value := range DefaultPragmas {
+		merged[name] = value
+	}
+	for name, value := range config.Pragmas {
+		merged[name] = value
+	}
+	var pragmas []string
+	for name, value := range merged {
+		if value == "" {
+			continue
+		}
+		// they end up in SQL, and pragmas can't take parameters
+		if !isPragmaWord(name) || !isPragmaWord(strings.TrimPrefix(value, "-")) {
+			return nil, fmt.Errorf("invalid pragma %s = %s", name, value)
+		}
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA %s = %s", name, value))
+	}
+	sort.Strings(pragmas)
+	return pragmas, nil
+}
+
+// ParsePragmas parses pragmas written like "cache_size=-20000,foreign_keys=on"
+// for DBConfig.Pragmas.
+func ParsePragmas(s string) (map[string]string, error) {
+	pragmas := map[string]string{}
+	for _, pragma := range strings.Split(s, ",") {
+		if strings.TrimSpace(pragma) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pragma, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pragma %q, expected name=value", pragma)
+		}
+		pragmas[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return pragmas, nil
+}
+
+func isPragmaWord(s string) bool {
+	for _, c := range s {
+		if !(c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// NewConnector returns a connector for sql.OpenDB that sets the pragmas of
+// config on every connection it opens, rather than on whichever connection
+// of the pool happens to run them.
+func NewConnector(dsn string, config DBConfig) (driver.Connector, error) {
+	pragmas, err := config.pragmas()
+	if err != nil {
+		return nil, err
+	}
+	return connector{dsn: dsn, pragmas: pragmas}, nil
+}
+
+type connector struct {
+	dsn     string
+	pragmas []string
+}
+
+func (c connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return countedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, pragma := range c.pragmas {
+				if _, err := conn.Exec(pragma, nil); err != nil {
+					return fmt.Errorf("cannot set up connection with %s: %w", pragma, err)
+				}
+			}
+			return nil
+		},
+	}
 }
 
 func CreateAndMigrateDb(ctx context.Context, dsn string) (*DB, error) {
-	db, err := sql.Open("sqlite3", dsn)
+	db, err := OpenDb(ctx, dsn, DBConfig{})
 	if err != nil {
-		return nil, fmt.Errorf("cannot open db: %w", err)
+		return nil, err
 	}
-	if err := migrate(ctx, db); err != nil {
+	if err := db.Migrate(ctx, MigrateConfig{}); err != nil {
 		// if we can't migrate, close the DB
 		db.Close()
 		return nil, fmt.Errorf("cannot migrate db: %w", err)
 	}
-	return &DB{
-		Queries: model.New(db),
-		db:      db,
-	}, nil
+	return db, nil
+}
+
+// OpenDb opens the database without migrating it, for tools that manage
+// migrations themselves.
+func OpenDb(ctx context.Context, dsn string, config DBConfig) (*DB, error) {
+	// transactions take the write lock up front, a deferred one that reads
+	// first can't wait for it and fails with SQLITE_BUSY instead
+	connector, err := NewConnector(withParams(dsn, "_txlock=immediate"), config)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+	// closing the connection would lose an in-memory database
+	db.SetConnMaxIdleTime(0)
+	db.SetConnMaxLifetime(0)
+
+	// these are the database's rather than the connection's, auto_vacuum only
+	// takes for new databases, see Vacuum
+	if _, err := db.ExecContext(ctx, `PRAGMA auto_vacuum = incremental; PRAGMA journal_mode = WAL`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot set up db: %w", err)
+	}
+
+	// every connection to :memory: is a database of its own
+	read := db
+	if !isMemory(dsn) {
+		readConfig := DBConfig{Pragmas: map[string]string{}}
+		for name, value := range config.Pragmas {
+			readConfig.Pragmas[name] = value
+		}
+		readConfig.Pragmas["query_only"] = "on"
+		connector, err := NewConnector(dsn, readConfig)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		read = sql.OpenDB(connector)
+		read.SetMaxOpenConns(max(4, runtime.NumCPU()))
+		read.SetMaxIdleConns(max(4, runtime.NumCPU()))
+	}
+	if config.SlowQuery == 0 {
+		config.SlowQuery = 100 * time.Millisecond
+	}
+	d := &DB{
+		db:        db,
+		read:      read,
+		retry:     config.Retry.withDefaults(),
+		slowQuery: config.SlowQuery,
+		explains:  make(chan struct{}, maxExplains),
+	}
+	d.Queries = model.New(d.instrument(db))
+	d.ReadQueries = model.New(d.instrument(read))
+	return d, nil
+}
+
+// withParams adds query parameters to a DSN, which may have some already.
+func withParams(dsn, params string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + params
+	}
+	return dsn + "?" + params
+}
+
+func isMemory(dsn string) bool {
+	return dsn == "" || strings.HasPrefix(dsn, ":memory:") || strings.HasPrefix(dsn, "file::memory:") ||
+		strings.Contains(dsn, "mode=memory")
+}
+
+// ErrReadOnlyTransaction is returned by Transaction when it's called within
+// a ReadTransaction.
+var ErrReadOnlyTransaction = errors.New("can't write in a read-only transaction")
+
+// activeTx is the transaction a context carries, so whatever is called with
+// the context joins it.
+type activeTx struct {
+	db      *DB
+	queries *model.Queries
+	tx      *sql.Tx
+	write   bool
+	// depth is how many savepoints deep the context is
+	depth int
+}
+
+type txKey struct{}
+
+func (db *DB) activeTx(ctx context.Context) *activeTx {
+	active, _ := ctx.Value(txKey{}).(*activeTx)
+	if active == nil || active.db != db {
+		return nil
+	}
+	return active
+}
+
+// queries returns the queries of the transaction in ctx, or of the write
+// connection outside of one.
+func (db *DB) queries(ctx context.Context) *model.Queries {
+	if active := db.activeTx(ctx); active != nil {
+		return active.queries
+	}
+	return db.Queries
 }
 
+// readQueries returns the queries of the transaction in ctx, which sees its
+// own writes, or of the read connections outside of one.
+func (db *DB) readQueries(ctx context.Context) *model.Queries {
+	if active := db.activeTx(ctx); active != nil {
+		return active.queries
+	}
+	return db.ReadQueries
+}
+
+// Transaction runs run in a write transaction, on the write connection.
+// When the database is busy or locked the transaction is rolled back and run
+// is called again, so it should do nothing but query.
+//
+// The transaction is carried in the context run gets, service methods
+// called with it join the transaction. Transaction called within one runs in
+// a savepoint instead, which is rolled back on its own if run fails. A
+// transaction mustn't be used by several goroutines at once.
 func (db *DB) Transaction(ctx context.Context, run func(context.Context, *model.Queries) error) error {
-	tx, err := db.db.BeginTx(ctx, nil)
+	if active := db.activeTx(ctx); active != nil {
+		if !active.write {
+			return ErrReadOnlyTransaction
+		}
+		return savepoint(ctx, active, run)
+	}
+	return db.retryBusy(ctx, "write", func() error {
+		return db.transaction(ctx, db.db, true, run)
+	})
+}
+
+// ReadTransaction runs run in a read-only transaction, so everything it
+// reads is from the same snapshot without holding up writers. Within another
+// transaction it joins that one.
+func (db *DB) ReadTransaction(ctx context.Context, run func(context.Context, *model.Queries) error) error {
+	if active := db.activeTx(ctx); active != nil {
+		return savepoint(ctx, active, run)
+	}
+	return db.retryBusy(ctx, "read", func() error {
+		return db.transaction(ctx, db.read, false, run)
+	})
+}
+
+func (db *DB) transaction(ctx context.Context, pool *sql.DB, write bool, run func(context.Context, *model.Queries) error) error {
+	tx, err := pool.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	queries := db.Queries.WithTx(tx)
-	err = run(ctx, queries)
+	active := &activeTx{db: db, queries: model.New(db.instrument(tx)), tx: tx, write: write}
+	err = run(context.WithValue(ctx, txKey{}, active), active.queries)
 	if err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-func (db *DB) Close() error {
-	return db.db.Close()
+// savepoint runs run in a savepoint of the active transaction, undoing only
+// what run did if it fails.
+func savepoint(ctx context.Context, active *activeTx, run func(context.Context, *model.Queries) error) error {
+	nested := *active
+	nested.depth++
+	name := fmt.Sprintf("sp%d", nested.depth)
+	if _, err := active.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	if err := run(context.WithValue(ctx, txKey{}, &nested), nested.queries); err != nil {
+		// rolling back to a savepoint leaves it open, it's released as well
+		if _, rollbackErr := active.tx.ExecContext(ctx, "ROLLBACK TO "+name); rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		if _, releaseErr := active.tx.ExecContext(ctx, "RELEASE "+name); releaseErr != nil {
+			return errors.Join(err, releaseErr)
+		}
+		return err
+	}
+	_, err := active.tx.ExecContext(ctx, "RELEASE "+name)
+	return err
 }
 
-func migrate(ctx context.Context, db *sql.DB) error {
+// retryBusy calls try until it doesn't fail with a busy error, it runs out
+// of attempts or ctx is done.
+func (db *DB) retryBusy(ctx context.Context, pool string, try func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := try()
+		if !isBusy(err) {
+			return err
+		}
+		if attempt >= db.retry.Attempts {
+			transactionBusyFailures.WithLabelValues(pool).Inc()
+			return err
+		}
+		timer := time.NewTimer(db.retry.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			transactionBusyFailures.WithLabelValues(pool).Inc()
+			return err
+		case <-timer.C:
+		}
+		transactionRetries.WithLabelValues(pool).Inc()
+	}
+}
 
-	// set up the connection
-	if _, err := db.ExecContext(ctx, `
-		PRAGMA busy_timeout = 5000;
-		PRAGMA journal_mode = WAL;
-		PRAGMA synchronous = NORMAL;
-		PRAGMA foreign_keys = ON;
-	`); err != nil {
-		return fmt.Errorf("cannot set up pragmas: %w", err)
+// isBusy reports whether err is SQLite giving up on a lock another
+// connection holds, which may well be released by trying again.
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
 	}
+	return false
+}
 
-	if _, err := db.ExecContext(ctx, `create table if not exists migrations (name text primary key);`); err != nil {
-		return fmt.Errorf("cannot create migrations table: %w", err)
+// isUniqueViolation reports whether err is a unique or primary key
+// constraint failure.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
 	}
+	return false
+}
 
-	// get all saved migrations from DB and build a map
-	rows, err := db.QueryContext(ctx, `select name from migrations`)
+type TableSize struct {
+	Name string
+	Rows int64
+}
+
+// TableSizes counts the rows of every table, largest first.
+func (db *DB) TableSizes(ctx context.Context) ([]TableSize, error) {
+	rows, err := db.read.QueryContext(ctx, `select name from sqlite_schema where type = 'table' and name not like 'sqlite_%' order by name`)
 	if err != nil {
-		return fmt.Errorf("cannot load migrations table: %w", err)
+		return nil, err
 	}
-	migrations := map[string]bool{}
+	var names []string
 	for rows.Next() {
 		var name string
-		if err = rows.Scan(&name); err != nil {
-			return fmt.Errorf("cannot scan migration row: %w", err)
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
 		}
-
-		migrations[name] = true
+		names = append(names, name)
 	}
-
-	names, err := fs.Glob(migrationFS, "db/migrations/*.sql")
-	if err != nil {
-		return fmt.Errorf("cannot load migration files: %w", err)
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	sort.Strings(names)
+	sizes := make([]TableSize, 0, len(names))
 	for _, name := range names {
-		// run only migrations that aren't already saved in the DB
-		if !migrations[name] {
-			if err = migrateFile(db, name); err != nil {
-				return fmt.Errorf("cannot migrate file %s: %w", name, err)
-			}
+		size := TableSize{Name: name}
+		// names come from the schema, quoting them is only for odd characters
+		query := fmt.Sprintf(`select count(*) from "%s"`, strings.ReplaceAll(name, `"`, `""`))
+		if err := db.read.QueryRowContext(ctx, query).Scan(&size.Rows); err != nil {
+			return nil, err
 		}
+		sizes = append(sizes, size)
 	}
-	return nil
+	sort.SliceStable(sizes, func(i, j int) bool { return sizes[i].Rows > sizes[j].Rows })
+	return sizes, nil
 }
 
-func migrateFile(db *sql.DB, name string) error {
-	fmt.Printf("applying migration %s\n", name)
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+// CheckpointResult is what a WAL checkpoint did.
+type CheckpointResult struct {
+	Mode string
+	// Busy is set if readers or writers kept the checkpoint from finishing.
+	Busy bool
+	// Frames is how many frames the WAL has, Checkpointed how many of them
+	// are in the database now.
+	Frames       int
+	Checkpointed int
+	At           time.Time
+}
 
-	// Read and execute migration file.
-	if buf, err := fs.ReadFile(migrationFS, name); err != nil {
-		return err
-	} else if _, err := tx.Exec(string(buf)); err != nil {
-		return err
+// Checkpoint copies the WAL into the database. The mode is passive, full,
+// restart or truncate, as for PRAGMA wal_checkpoint.
+func (db *DB) Checkpoint(ctx context.Context, mode string) (CheckpointResult, error) {
+	switch mode {
+	case "passive", "full", "restart", "truncate":
+	default:
+		return CheckpointResult{}, fmt.Errorf("invalid checkpoint mode %s", mode)
 	}
+	return db.checkpoint(ctx, db.db, mode)
+}
 
-	// Insert record into migrations to prevent re-running migration.
-	if _, err := tx.Exec(`insert into migrations (name) values (?)`, name); err != nil {
-		return err
+// checkpoint runs a checkpoint on one of pool's connections and remembers
+// how it went for the metrics.
+func (db *DB) checkpoint(ctx context.Context, pool *sql.DB, mode string) (CheckpointResult, error) {
+	result := CheckpointResult{Mode: mode}
+	var busy int
+	err := pool.QueryRowContext(ctx, fmt.Sprintf(`pragma wal_checkpoint(%s)`, mode)).Scan(&busy, &result.Frames, &result.Checkpointed)
+	if err != nil {
+		return result, err
 	}
+	result.Busy, result.At = busy != 0, time.Now()
+	db.mu.Lock()
+	db.lastCheckpoint = result
+	db.mu.Unlock()
+	return result, nil
+}
 
-	return tx.Commit()
+// Size returns the size of the main database file in bytes.
+func (db *DB) Size(ctx context.Context) (int64, error) {
+	var size int64
+	err := db.read.QueryRowContext(ctx, `select page_count * page_size from pragma_page_count(), pragma_page_size()`).Scan(&size)
+	return size, err
+}
+
+func (db *DB) Close() error {
+	var err error
+	if db.read != db.db {
+		err = db.read.Close()
+	}
+	if closeErr := db.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
@@ -0,0 +1,27 @@
+-- +migrate Up
+create table webauthn_credential(
+    id integer primary key autoincrement,
+    user_id integer not null references user(id),
+    credential_id blob not null unique,
+    public_key blob not null,
+    attestation_type text not null,
+    transports text not null default '',
+    aaguid blob not null,
+    sign_count integer not null default 0,
+    backup_eligible boolean not null default false,
+    backup_state boolean not null default false,
+    created_at datetime not null default current_timestamp
+);
+
+create index webauthn_credential_user_id_idx on webauthn_credential(user_id);
+
+-- challenge state for an in-flight registration or login ceremony
+create table webauthn_session(
+    id text primary key,
+    data blob not null,
+    expires_at datetime not null
+);
+
+-- +migrate Down
+drop table webauthn_session;
+drop table webauthn_credential;
@@ -0,0 +1,25 @@
+-- +migrate Up
+create table oidc_identity(
+    id integer primary key autoincrement,
+    user_id integer not null references user(id),
+    issuer text not null,
+    subject text not null,
+    created_at datetime not null default current_timestamp,
+
+    unique(issuer, subject)
+);
+
+create index oidc_identity_user_id_idx on oidc_identity(user_id);
+
+-- in-flight authorization requests, keyed by their state parameter
+create table oidc_state(
+    state text primary key,
+    nonce text not null,
+    code_verifier text not null,
+    next text not null default '',
+    expires_at datetime not null
+);
+
+-- +migrate Down
+drop table oidc_state;
+drop table oidc_identity;
@@ -0,0 +1,12 @@
+-- +migrate Up
+-- failed attempts per rate limited key, like an ip address or a username.
+-- times are unix seconds.
+create table login_attempt(
+    key text primary key,
+    failures integer not null default 0,
+    locked_until integer not null default 0,
+    updated_at integer not null
+);
+
+-- +migrate Down
+drop table login_attempt;
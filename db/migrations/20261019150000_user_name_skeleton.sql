@@ -0,0 +1,14 @@
+-- +migrate Up
+-- the skeleton folds usernames that look alike into the same value, it must
+-- match usernameSkeleton in username.go
+alter table user add column user_name_skeleton text not null default '';
+
+update user set user_name_skeleton =
+    replace(replace(replace(replace(replace(replace(replace(replace(
+        user_name, '.', ''), '-', ''), '_', ''), '0', 'o'), '1', 'l'), 'i', 'l'), 'rn', 'm'), 'vv', 'w');
+
+create index user_name_skeleton_idx on user(user_name_skeleton);
+
+-- +migrate Down
+drop index user_name_skeleton_idx;
+alter table user drop column user_name_skeleton;
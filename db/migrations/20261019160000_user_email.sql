@@ -0,0 +1,22 @@
+-- +migrate Up
+-- email is optional, and only unique once verified so nobody can hold on to
+-- an address they don't control
+alter table user add column email text;
+alter table user add column email_verified_at datetime;
+
+create unique index user_verified_email_idx on user(email) where email_verified_at is not null;
+
+create table email_verification(
+    token text primary key,
+    user_id integer not null references user(id),
+    email text not null,
+    expires_at datetime not null
+);
+
+create index email_verification_user_id_idx on email_verification(user_id);
+
+-- +migrate Down
+drop table email_verification;
+drop index user_verified_email_idx;
+alter table user drop column email_verified_at;
+alter table user drop column email;
@@ -0,0 +1,38 @@
+-- +migrate Up
+alter table user add column is_admin boolean not null default false;
+alter table user add column disabled_at datetime;
+
+-- sessions an admin opened as another user record who they really are
+alter table session add column impersonator_id integer references user(id);
+
+create table admin_audit(
+    id integer primary key autoincrement,
+    admin_id integer not null references user(id),
+    action text not null,
+    target_user_id integer references user(id),
+    created_at datetime not null default current_timestamp
+);
+
+create index admin_audit_created_at_idx on admin_audit(created_at);
+
+-- +migrate Down
+drop table admin_audit;
+
+-- columns in a foreign key can't be dropped, the table has to be rebuilt
+create table session_old(
+    id text primary key,
+    team_user_id integer not null references team_user(id),
+    created_at datetime not null default current_timestamp,
+    expires_at datetime not null
+);
+
+insert into session_old(id, team_user_id, created_at, expires_at)
+select id, team_user_id, created_at, expires_at from session where impersonator_id is null;
+
+drop table session;
+alter table session_old rename to session;
+
+create index session_expires_at_idx on session(expires_at);
+
+alter table user drop column disabled_at;
+alter table user drop column is_admin;
@@ -0,0 +1,36 @@
+-- +migrate Up
+-- audit entries outlive the accounts they mention, so both user references
+-- become nullable and are cleared when an account is deleted
+create table admin_audit_new(
+    id integer primary key autoincrement,
+    admin_id integer references user(id),
+    action text not null,
+    target_user_id integer references user(id),
+    created_at datetime not null default current_timestamp
+);
+
+insert into admin_audit_new(id, admin_id, action, target_user_id, created_at)
+select id, admin_id, action, target_user_id, created_at from admin_audit;
+
+drop table admin_audit;
+alter table admin_audit_new rename to admin_audit;
+
+create index admin_audit_created_at_idx on admin_audit(created_at);
+
+-- +migrate Down
+-- entries about deleted accounts can't be kept once the columns are required
+create table admin_audit_old(
+    id integer primary key autoincrement,
+    admin_id integer not null references user(id),
+    action text not null,
+    target_user_id integer references user(id),
+    created_at datetime not null default current_timestamp
+);
+
+insert into admin_audit_old(id, admin_id, action, target_user_id, created_at)
+select id, admin_id, action, target_user_id, created_at from admin_audit where admin_id is not null;
+
+drop table admin_audit;
+alter table admin_audit_old rename to admin_audit;
+
+create index admin_audit_created_at_idx on admin_audit(created_at);
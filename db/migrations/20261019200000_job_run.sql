@@ -0,0 +1,13 @@
+-- +migrate Up
+create table job_run(
+    id integer primary key autoincrement,
+    job text not null,
+    started_at datetime not null,
+    finished_at datetime,
+    error text
+);
+
+create index job_run_job_idx on job_run(job, id);
+
+-- +migrate Down
+drop table job_run;
@@ -0,0 +1,10 @@
+-- +migrate Up
+-- the team single sign-on users are provisioned into, kept by id since team
+-- names aren't unique and anyone can sign up with a team's name
+create table oidc_team(
+    name text primary key,
+    team_id integer not null references team(id) on delete cascade
+);
+
+-- +migrate Down
+drop table oidc_team;
@@ -0,0 +1,16 @@
+-- +migrate Up
+-- lookalike usernames are refused by the skeleton, so it's unique like the
+-- username itself. Users who already share a skeleton keep their names, the
+-- later ones get a skeleton no username can have.
+update user set user_name_skeleton = user_name_skeleton || ':' || id
+where exists (
+    select 1 from user as older
+    where older.user_name_skeleton = user.user_name_skeleton and older.id < user.id
+);
+
+drop index user_name_skeleton_idx;
+create unique index user_name_skeleton_idx on user(user_name_skeleton);
+
+-- +migrate Down
+drop index user_name_skeleton_idx;
+create index user_name_skeleton_idx on user(user_name_skeleton);
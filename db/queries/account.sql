@@ -0,0 +1,42 @@
+-- name: ListSoleTeams :many
+select team_id from team_user
+where user_id = ? and not exists (
+    select 1 from team_user as other
+    where other.team_id = team_user.team_id and other.user_id != team_user.user_id
+);
+
+-- name: DeleteImpersonationSessions :exec
+delete from session where impersonator_id = ?;
+
+-- name: DeleteUserTeamUsers :exec
+delete from team_user where user_id = ?;
+
+-- name: DeleteTeam :exec
+delete from team where id = ?;
+
+-- name: DeleteUserDials :exec
+delete from dial where user_id = ?;
+
+-- name: DeleteUserWebAuthnCredentials :exec
+delete from webauthn_credential where user_id = ?;
+
+-- name: DeleteUserOIDCIdentities :exec
+delete from oidc_identity where user_id = ?;
+
+-- name: ClearUserAdminAudit :exec
+update admin_audit
+set admin_id = nullif(admin_id, @user_id), target_user_id = nullif(target_user_id, @user_id)
+where admin_id = @user_id or target_user_id = @user_id;
+
+-- name: DeleteUser :exec
+delete from user where id = ?;
+
+-- name: ListUserOIDCIdentities :many
+select * from oidc_identity where user_id = ? order by id;
+
+-- name: ListUserSessions :many
+select session.created_at, session.expires_at, session.impersonator_id is not null as impersonated
+from session
+join team_user on team_user.id = session.team_user_id
+where team_user.user_id = ?
+order by session.created_at;
@@ -0,0 +1,37 @@
+-- name: ListUsers :many
+select user.id, user.user_name, user.email, user.email_verified_at, user.is_admin, user.disabled_at, user.created_at,
+    (select count(*) from team_user where team_user.user_id = user.id) as team_count
+from user
+order by user.id;
+
+-- name: ListAllTeams :many
+select team.id, team.name, team.created_at,
+    (select count(*) from team_user where team_user.team_id = team.id) as member_count
+from team
+order by team.id;
+
+-- name: SetAdmin :execrows
+update user set is_admin = ? where user_name = ?;
+
+-- name: SetDisabled :exec
+update user set disabled_at = ? where id = ?;
+
+-- name: DeleteUserSessions :exec
+delete from session where team_user_id in (select id from team_user where user_id = ?);
+
+-- name: CreateImpersonationSession :exec
+insert into session(id, team_user_id, expires_at, impersonator_id)
+values(?,?,?,?);
+
+-- name: CreateAdminAudit :exec
+insert into admin_audit(admin_id, action, target_user_id)
+values(?,?,?);
+
+-- name: ListAdminAudit :many
+select admin_audit.id, admin_audit.action, admin_audit.created_at,
+    admin.user_name as admin_name, target.user_name as target_name
+from admin_audit
+left join user as admin on admin.id = admin_audit.admin_id
+left join user as target on target.id = admin_audit.target_user_id
+order by admin_audit.id desc
+limit ?;
@@ -0,0 +1,12 @@
+-- name: CreateEmailVerification :exec
+insert into email_verification(token, user_id, email, expires_at)
+values(?,?,?,?);
+
+-- name: TakeEmailVerification :one
+delete from email_verification where token = ? returning user_id, email, expires_at;
+
+-- name: DeleteEmailVerifications :exec
+delete from email_verification where user_id = ?;
+
+-- name: DeleteExpiredEmailVerifications :execrows
+delete from email_verification where expires_at < current_timestamp;
@@ -0,0 +1,16 @@
+-- name: CreateJobRun :one
+insert into job_run(job, started_at)
+values(?,?)
+returning id;
+
+-- name: FinishJobRun :exec
+update job_run set finished_at = ?, error = ? where id = ?;
+
+-- name: PruneJobRuns :exec
+delete from job_run
+where job = ? and id <= (select id from job_run where job = ? order by id desc limit 1 offset ?);
+
+-- name: ListJobRuns :many
+select id, job, started_at, finished_at, error from job_run
+order by id desc
+limit ?;
@@ -0,0 +1,22 @@
+-- name: GetLoginAttempt :one
+select * from login_attempt where key = ?;
+
+-- name: RecordLoginFailure :one
+insert into login_attempt(key, failures, updated_at)
+values(sqlc.arg(key), 1, sqlc.arg(now))
+on conflict(key) do update set
+    failures = case when login_attempt.updated_at < sqlc.arg(reset_before) then 1 else login_attempt.failures + 1 end,
+    updated_at = excluded.updated_at
+returning failures;
+
+-- name: LockLoginAttempt :exec
+update login_attempt set locked_until = ? where key = ?;
+
+-- name: DeleteLoginAttempt :exec
+delete from login_attempt where key = ?;
+
+-- name: ForgiveLoginFailure :exec
+update login_attempt set failures = failures - 1 where key = ? and failures > 0;
+
+-- name: DeleteStaleLoginAttempts :execrows
+delete from login_attempt where updated_at < sqlc.arg(reset_before) and locked_until < sqlc.arg(now);
@@ -0,0 +1,23 @@
+-- name: CreateOIDCState :exec
+insert into oidc_state(state, nonce, code_verifier, next, expires_at)
+values(?,?,?,?,?);
+
+-- name: TakeOIDCState :one
+delete from oidc_state where state = ? returning nonce, code_verifier, next, expires_at;
+
+-- name: GetOIDCIdentity :one
+select user_id from oidc_identity where issuer = ? and subject = ?;
+
+-- name: CreateOIDCIdentity :exec
+insert into oidc_identity(user_id, issuer, subject)
+values(?,?,?);
+
+-- name: DeleteExpiredOIDCStates :execrows
+delete from oidc_state where expires_at < current_timestamp;
+
+-- name: GetOIDCTeam :one
+select team_id from oidc_team where name = ?;
+
+-- name: CreateOIDCTeam :exec
+insert into oidc_team(name, team_id)
+values(?,?);
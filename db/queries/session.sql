@@ -6,4 +6,21 @@ values(?,?,?);
 delete from session where id = ?;
 
 -- name: GetSession :one
-select team_user_id, expires_at < current_timestamp as expired from session where id = ?;
\ No newline at end of file
+select session.team_user_id, session.expires_at < current_timestamp as expired, session.impersonator_id,
+    user.disabled_at is not null or (session.impersonator_id is not null and (
+        impersonator.id is null or impersonator.disabled_at is not null or not impersonator.is_admin
+    )) as disabled
+from session
+join team_user on team_user.id = session.team_user_id
+join user on user.id = team_user.user_id
+left join user as impersonator on impersonator.id = session.impersonator_id
+where session.id = ?;
+
+-- name: IsTeamUserDisabled :one
+select user.disabled_at is not null as disabled
+from team_user
+join user on user.id = team_user.user_id
+where team_user.id = ?;
+
+-- name: DeleteExpiredSessions :execrows
+delete from session where expires_at < current_timestamp;
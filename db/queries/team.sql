@@ -17,4 +17,5 @@ select * from team_user where id = ?;
 select team_user.id as team_user_id, sqlc.embed(team)
 from team_user
 join team on team_user.team_id = team.id
-where team_user.user_id = ?
\ No newline at end of file
+where team_user.user_id = ?;
+
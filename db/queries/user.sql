@@ -1,11 +1,14 @@
 -- name: CreateUser :one
-insert into user(user_name, password)
-values(?,?)
+insert into user(user_name, user_name_skeleton, password)
+values(?,?,?)
 returning id;
 
 -- name: GetUserByUsername :one
 select user.* from user where user_name = ?;
 
+-- name: UsernameSkeletonExists :one
+select exists(select 1 from user where user_name_skeleton = ?);
+
 -- name: GetUserById :one
 select * from user where id = ?;
 
@@ -13,4 +16,13 @@ select * from user where id = ?;
 update user set user_name = ? where id = ?;
 
 -- name: SetPassword :exec
-update user set password = ? where id = ?;
\ No newline at end of file
+update user set password = ? where id = ?;
+
+-- name: GetUserByVerifiedEmail :one
+select user.* from user where email = ? and email_verified_at is not null;
+
+-- name: SetEmail :exec
+update user set email = ?, email_verified_at = null where id = ?;
+
+-- name: VerifyEmail :execrows
+update user set email_verified_at = ? where id = ? and email = ?;
@@ -0,0 +1,21 @@
+-- name: CreateWebAuthnCredential :exec
+insert into webauthn_credential(user_id, credential_id, public_key, attestation_type, transports, aaguid, sign_count, backup_eligible, backup_state)
+values(?,?,?,?,?,?,?,?,?);
+
+-- name: ListWebAuthnCredentials :many
+select * from webauthn_credential
+where user_id = ?
+order by created_at;
+
+-- name: UpdateWebAuthnCredential :exec
+update webauthn_credential set sign_count = ?, backup_state = ? where credential_id = ?;
+
+-- name: CreateWebAuthnSession :exec
+insert into webauthn_session(id, data, expires_at)
+values(?,?,?);
+
+-- name: TakeWebAuthnSession :one
+delete from webauthn_session where id = ? returning data, expires_at;
+
+-- name: DeleteExpiredWebAuthnSessions :execrows
+delete from webauthn_session where expires_at < current_timestamp;
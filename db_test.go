@@ -0,0 +1,424 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sqlite"
+	"sqlite/model"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestPools(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	_, err = db.ReadQueries.CreateUser(ctx, model.CreateUserParams{UserName: "foo", Password: []byte("foo")})
+	if err == nil {
+		t.Fatal("expected the read connections to refuse writes")
+	}
+	id, err := db.Queries.CreateUser(ctx, model.CreateUserParams{UserName: "foo", Password: []byte("foo")})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	ctx = sqlite.ContextWithUser(ctx, model.TeamUser{UserID: id})
+	svc := sqlite.NewDialService(db)
+	dialID, err := svc.Create(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	// writers queue for the write connection rather than failing busy
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(value int64) {
+			defer wg.Done()
+			errs <- svc.SetValue(ctx, sqlite.SetDialValue{ID: dialID, Value: value})
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.ReadTransaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		_, err := q.GetDial(ctx, model.GetDialParams{UserID: id, ID: dialID})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForeignKeysEveryConnection(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "app.db")
+	db, err := sqlite.CreateAndMigrateDb(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	connector, err := sqlite.NewConnector(path, sqlite.DBConfig{Pragmas: map[string]string{"cache_size": "-4000"}})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	pool := sql.OpenDB(connector)
+	defer pool.Close()
+
+	// holding on to each connection makes the pool open another
+	for i := 0; i < 5; i++ {
+		conn, err := pool.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+		defer conn.Close()
+		var foreignKeys, cacheSize int
+		if err := conn.QueryRowContext(ctx, `select foreign_keys, cache_size from pragma_foreign_keys(), pragma_cache_size()`).Scan(&foreignKeys, &cacheSize); err != nil {
+			t.Fatal(err)
+			return
+		}
+		if foreignKeys != 1 || cacheSize != -4000 {
+			t.Fatalf("expected connection %d to be set up, got foreign_keys %d and cache_size %d", i, foreignKeys, cacheSize)
+		}
+		if _, err := conn.ExecContext(ctx, `insert into dial (user_id, name) values (12345, 'orphan')`); err == nil {
+			t.Fatalf("expected connection %d to refuse a dial without a user", i)
+		}
+	}
+
+	if _, err := sqlite.NewConnector(path, sqlite.DBConfig{Pragmas: map[string]string{"cache_size": "1; drop table user"}}); err == nil {
+		t.Fatal("expected pragmas that aren't plain words to be refused")
+	}
+	pragmas, err := sqlite.ParsePragmas("cache_size=-4000, foreign_keys=off")
+	if err != nil || len(pragmas) != 2 || pragmas["foreign_keys"] != "off" {
+		t.Fatalf("expected two pragmas, got %v %v", pragmas, err)
+	}
+}
+
+func TestTransactionRetry(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "app.db")
+	db, err := sqlite.OpenDb(ctx, path, sqlite.DBConfig{
+		// fail at once rather than have SQLite wait, so the retries do
+		Pragmas: map[string]string{"busy_timeout": "0"},
+		Retry:   sqlite.RetryConfig{Attempts: 4, Backoff: 20 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{SkipBackup: true}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	other, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer other.Close()
+	lock := func() (unlock func()) {
+		conn, err := other.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.ExecContext(ctx, `begin immediate`); err != nil {
+			t.Fatal(err)
+		}
+		return func() {
+			conn.ExecContext(ctx, `rollback`)
+			conn.Close()
+		}
+	}
+	createUser := func(ctx context.Context, name string) error {
+		return db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+			_, err := q.CreateUser(ctx, model.CreateUserParams{UserName: name, UserNameSkeleton: name, Password: []byte("foo")})
+			return err
+		})
+	}
+
+	unlock := lock()
+	time.AfterFunc(30*time.Millisecond, unlock)
+	if err := createUser(ctx, "foo"); err != nil {
+		t.Fatalf("expected the transaction to be retried until the lock is released, got %v", err)
+	}
+
+	unlock = lock()
+	defer unlock()
+	var sqliteErr sqlite3.Error
+	if err := createUser(ctx, "bar"); !errors.As(err, &sqliteErr) || sqliteErr.Code != sqlite3.ErrBusy {
+		t.Fatalf("expected SQLITE_BUSY after the last attempt, got %v", err)
+	}
+
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := createUser(cancelled, "bar"); err == nil {
+		t.Fatal("expected the transaction to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected retrying to stop with the context, took %v", elapsed)
+	}
+}
+
+func TestNestedTransactions(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	id, err := db.Queries.CreateUser(ctx, model.CreateUserParams{UserName: "foo", Password: []byte("foo")})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	ctx = sqlite.ContextWithUser(ctx, model.TeamUser{UserID: id})
+	svc := sqlite.NewDialService(db)
+	names := func() string {
+		dials, err := svc.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, dial := range dials {
+			names = append(names, dial.Name)
+		}
+		return fmt.Sprint(names)
+	}
+	errFailed := errors.New("failed")
+
+	err = db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		// the service joins the transaction rather than waiting for it
+		if _, err := svc.Create(ctx, "kept"); err != nil {
+			return err
+		}
+		err := db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+			if _, err := svc.Create(ctx, "nested"); err != nil {
+				return err
+			}
+			return db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+				_, err := svc.Create(ctx, "nested twice")
+				return err
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+			if _, err := svc.Create(ctx, "undone"); err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if err != errFailed {
+			return fmt.Errorf("expected the savepoint to fail, got %v", err)
+		}
+		// reads within the transaction see what it wrote
+		dials, err := svc.List(ctx)
+		if err != nil {
+			return err
+		}
+		if len(dials) != 3 {
+			return fmt.Errorf("expected 3 dials within the transaction, got %d", len(dials))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if names := names(); names != "[kept nested nested twice]" {
+		t.Fatalf("expected only the failed savepoint to be undone, got %s", names)
+	}
+
+	err = db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		err := db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+			_, err := svc.Create(ctx, "gone")
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("expected the transaction to fail, got %v", err)
+	}
+	if names := names(); names != "[kept nested nested twice]" {
+		t.Fatalf("expected the released savepoint to be undone with the transaction, got %s", names)
+	}
+
+	err = db.ReadTransaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		return db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+			return nil
+		})
+	})
+	if err != sqlite.ErrReadOnlyTransaction {
+		t.Fatalf("expected ErrReadOnlyTransaction, got %v", err)
+	}
+}
+
+func TestServicesJoinTransactions(t *testing.T) {
+	// on the single write connection a service that doesn't join the
+	// transaction waits for it forever, the deadline turns that into a failure
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	authService := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+	adminService := sqlite.NewAdminService(db)
+	if _, err := authService.Signup(ctx, sqlite.AuthInput{UserName: "foo", Password: testPassword}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	errFailed := errors.New("failed")
+	var token string
+	err = db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		output, err := authService.Login(ctx, sqlite.AuthInput{UserName: "foo", Password: testPassword})
+		if err != nil {
+			return err
+		}
+		token = output.Token
+		teamUser, err := authService.GetTeamUserFromSession(ctx, token)
+		if err != nil {
+			return err
+		}
+		if err := adminService.Record(sqlite.ContextWithUser(ctx, teamUser), "looked around"); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("expected the transaction to fail, got %v", err)
+	}
+	if token == "" {
+		t.Fatal("expected a session within the transaction")
+	}
+	// and everything they wrote is undone with it
+	if teamUser, _ := authService.GetTeamUserFromSession(ctx, token); teamUser.ID != 0 {
+		t.Fatal("expected the session to be rolled back")
+	}
+	if audit, err := db.Queries.ListAdminAudit(ctx, 10); err != nil || len(audit) != 0 {
+		t.Fatalf("expected the audit entry to be rolled back, got %v %v", audit, err)
+	}
+}
+
+// BenchmarkSetValue sets dial values from many goroutines while others read
+// them, with a single default pool as before and with the read and write
+// pools. On one pool the deferred transactions can't wait for each other and
+// a good part fail with SQLITE_BUSY, errors/op counts them.
+func BenchmarkSetValue(b *testing.B) {
+	ctx := context.Background()
+	setup := func(b *testing.B) (*sqlite.DB, context.Context, int64, string) {
+		path := filepath.Join(b.TempDir(), "app.db")
+		db, err := sqlite.CreateAndMigrateDb(ctx, path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		id, err := db.Queries.CreateUser(ctx, model.CreateUserParams{UserName: "foo", Password: []byte("foo")})
+		if err != nil {
+			b.Fatal(err)
+		}
+		ctx := sqlite.ContextWithUser(ctx, model.TeamUser{UserID: id})
+		dialID, err := sqlite.NewDialService(db).Create(ctx, "test")
+		if err != nil {
+			b.Fatal(err)
+		}
+		return db, ctx, dialID, path
+	}
+	run := func(b *testing.B, setValue func(value int64) error, get func() error) {
+		var failed, n atomic.Int64
+		b.SetParallelism(8)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				// a write for every three reads
+				i := n.Add(1)
+				var err error
+				if i%4 == 0 {
+					err = setValue(i)
+				} else {
+					err = get()
+				}
+				if err != nil {
+					failed.Add(1)
+				}
+			}
+		})
+		b.ReportMetric(float64(failed.Load())/float64(b.N), "errors/op")
+	}
+
+	b.Run("one pool", func(b *testing.B) {
+		db, ctx, dialID, path := setup(b)
+		db.Close()
+		// set up like OpenDb used to
+		pool, err := sql.Open("sqlite3", path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer pool.Close()
+		if _, err := pool.ExecContext(ctx, `PRAGMA busy_timeout = 5000; PRAGMA synchronous = NORMAL;`); err != nil {
+			b.Fatal(err)
+		}
+		q := model.New(pool)
+		userID := sqlite.UserFromFromContext(ctx).UserID
+		get := func() error {
+			_, err := q.GetDial(ctx, model.GetDialParams{UserID: userID, ID: dialID})
+			return err
+		}
+		run(b, func(value int64) error {
+			// the check and the change in one transaction as SetValue does,
+			// which is deferred on this pool
+			tx, err := pool.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			q := q.WithTx(tx)
+			if _, err := q.GetDial(ctx, model.GetDialParams{UserID: userID, ID: dialID}); err != nil {
+				return err
+			}
+			if err := q.SetDialValue(ctx, model.SetDialValueParams{ID: dialID, Value: value}); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}, get)
+	})
+	b.Run("read and write pools", func(b *testing.B) {
+		db, ctx, dialID, _ := setup(b)
+		defer db.Close()
+		svc := sqlite.NewDialService(db)
+		run(b, func(value int64) error {
+			return svc.SetValue(ctx, sqlite.SetDialValue{ID: dialID, Value: value})
+		}, func() error {
+			_, err := svc.Get(ctx, dialID)
+			return err
+		})
+	})
+}
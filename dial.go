@@ -16,18 +16,18 @@ func NewDialService(db *DB) *DialService {
 }
 
 func (svc *DialService) Create(ctx context.Context, name string) (int64, error) {
-	return svc.db.Queries.CreateDial(ctx, model.CreateDialParams{
+	return svc.db.queries(ctx).CreateDial(ctx, model.CreateDialParams{
 		UserID: UserFromFromContext(ctx).UserID,
 		Name:   name,
 	})
 }
 
 func (svc *DialService) List(ctx context.Context) ([]model.Dial, error) {
-	return svc.db.Queries.ListDials(ctx, UserFromFromContext(ctx).UserID)
+	return svc.db.readQueries(ctx).ListDials(ctx, UserFromFromContext(ctx).UserID)
 }
 
 func (svc *DialService) Get(ctx context.Context, id int64) (model.Dial, error) {
-	return svc.db.Queries.GetDial(ctx, model.GetDialParams{
+	return svc.db.readQueries(ctx).GetDial(ctx, model.GetDialParams{
 		UserID: UserFromFromContext(ctx).UserID,
 		ID:     id,
 	})
@@ -39,13 +39,15 @@ type UpdateDial struct {
 }
 
 func (svc *DialService) Update(ctx context.Context, u UpdateDial) error {
-	_, err := svc.Get(ctx, u.ID)
-	if err != nil {
-		return err
-	}
-	return svc.db.Queries.UpdateDial(ctx, model.UpdateDialParams{
-		ID:   u.ID,
-		Name: u.Name,
+	return svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		// within the transaction, so the dial is still theirs when it's changed
+		if _, err := svc.Get(ctx, u.ID); err != nil {
+			return err
+		}
+		return q.UpdateDial(ctx, model.UpdateDialParams{
+			ID:   u.ID,
+			Name: u.Name,
+		})
 	})
 }
 
@@ -55,20 +57,22 @@ type SetDialValue struct {
 }
 
 func (svc *DialService) SetValue(ctx context.Context, v SetDialValue) error {
-	_, err := svc.Get(ctx, v.ID)
-	if err != nil {
-		return err
-	}
-	return svc.db.Queries.SetDialValue(ctx, model.SetDialValueParams{
-		Value: v.Value,
-		ID:    v.ID,
+	return svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		if _, err := svc.Get(ctx, v.ID); err != nil {
+			return err
+		}
+		return q.SetDialValue(ctx, model.SetDialValueParams{
+			Value: v.Value,
+			ID:    v.ID,
+		})
 	})
 }
 
 func (svc *DialService) Delete(ctx context.Context, id int64) error {
-	_, err := svc.Get(ctx, id)
-	if err != nil {
-		return err
-	}
-	return svc.db.Queries.DeleteDial(ctx, id)
+	return svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		if _, err := svc.Get(ctx, id); err != nil {
+			return err
+		}
+		return q.DeleteDial(ctx, id)
+	})
 }
@@ -18,8 +18,9 @@ func TestDialService(t *testing.T) {
 	svc := sqlite.NewDialService(db)
 
 	id, err := db.Queries.CreateUser(ctx, model.CreateUserParams{
-		UserName: "foo",
-		Password: []byte("foo"),
+		UserName:         "foo",
+		UserNameSkeleton: "foo",
+		Password:         []byte("foo"),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -62,8 +63,9 @@ func TestDialService(t *testing.T) {
 
 	// create another user
 	id2, err := db.Queries.CreateUser(ctx, model.CreateUserParams{
-		UserName: "bar",
-		Password: []byte("foo"),
+		UserName:         "bar",
+		UserNameSkeleton: "bar",
+		Password:         []byte("foo"),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,187 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"sqlite/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidEmail = errors.New("invalid email address")
+	// ErrTooManyEmails is returned when a user or an address was sent too
+	// many links lately.
+	ErrTooManyEmails = errors.New("too many emails")
+)
+
+// DefaultEmailRateLimitConfig lets a few links through, then one a minute
+// at first and one an hour at most.
+var DefaultEmailRateLimitConfig = RateLimitConfig{
+	FreeAttempts: 3,
+	BaseDelay:    time.Minute,
+	MaxDelay:     time.Hour,
+	ResetAfter:   24 * time.Hour,
+}
+
+type EmailConfig struct {
+	Mailer Mailer
+	// BaseURL is prepended to the links in emails, like
+	// https://silva.world.
+	BaseURL string
+	// RateLimit limits the links sent to each user and to each address, the
+	// zero value uses DefaultEmailRateLimitConfig.
+	RateLimit RateLimitConfig
+}
+
+type EmailService struct {
+	db      *DB
+	mailer  Mailer
+	limiter *RateLimiter
+	baseURL string
+}
+
+func NewEmailService(db *DB, config EmailConfig) *EmailService {
+	if config.RateLimit == (RateLimitConfig{}) {
+		config.RateLimit = DefaultEmailRateLimitConfig
+	}
+	return &EmailService{
+		db:      db,
+		mailer:  config.Mailer,
+		limiter: NewRateLimiter(db, config.RateLimit),
+		baseURL: strings.TrimSuffix(config.BaseURL, "/"),
+	}
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// SetEmail changes the email of the authenticated user and sends a link to
+// verify it. The address can't be used to log in until it's verified. An
+// empty email removes it. Admins impersonating the user can't change it, it
+// would let them take the account over.
+func (svc *EmailService) SetEmail(ctx context.Context, email string) error {
+	if ImpersonatorFromContext(ctx) != 0 {
+		return ErrImpersonating
+	}
+	user, err := svc.db.queries(ctx).GetUserById(ctx, UserFromFromContext(ctx).UserID)
+	if err != nil {
+		return err
+	}
+	email = normalizeEmail(email)
+	if email != "" {
+		// display names and comments are allowed by the parser but have no
+		// business in a stored address
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			return ErrInvalidEmail
+		}
+		if err := svc.throttle(ctx, user.ID, email); err != nil {
+			return err
+		}
+	}
+	err = svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		err := q.SetEmail(ctx, model.SetEmailParams{
+			Email: sql.NullString{String: email, Valid: email != ""},
+			ID:    user.ID,
+		})
+		if err != nil {
+			return err
+		}
+		// links sent for the previous address must stop working
+		return q.DeleteEmailVerifications(ctx, user.ID)
+	})
+	if err != nil || email == "" {
+		return err
+	}
+	return svc.sendVerification(ctx, user.ID, email)
+}
+
+// Resend sends a new verification link for the authenticated user's email,
+// and does nothing when it's missing or already verified.
+func (svc *EmailService) Resend(ctx context.Context) error {
+	user, err := svc.db.queries(ctx).GetUserById(ctx, UserFromFromContext(ctx).UserID)
+	if err != nil {
+		return err
+	}
+	if !user.Email.Valid || user.EmailVerifiedAt.Valid {
+		return nil
+	}
+	if err := svc.throttle(ctx, user.ID, user.Email.String); err != nil {
+		return err
+	}
+	if err := svc.db.queries(ctx).DeleteEmailVerifications(ctx, user.ID); err != nil {
+		return err
+	}
+	return svc.sendVerification(ctx, user.ID, user.Email.String)
+}
+
+// throttle counts a link about to be sent against the user and the address,
+// so neither can be used to flood an inbox, and returns ErrTooManyEmails when
+// one of them has to wait.
+func (svc *EmailService) throttle(ctx context.Context, userID int64, email string) error {
+	wait, err := svc.limiter.Attempt(ctx, "email-user:"+strconv.FormatInt(userID, 10), "email:"+email)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return ErrTooManyEmails
+	}
+	return nil
+}
+
+func (svc *EmailService) sendVerification(ctx context.Context, userID int64, email string) error {
+	token, err := randomString()
+	if err != nil {
+		return err
+	}
+	err = svc.db.queries(ctx).CreateEmailVerification(ctx, model.CreateEmailVerificationParams{
+		Token:     token,
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: time.Now().Add(24 * time.Hour),
+	})
+	if err != nil {
+		return err
+	}
+	link := svc.baseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return svc.mailer.Send(ctx, Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body:    fmt.Sprintf("Open this link within 24 hours to verify your email:\n\n%s\n", link),
+	})
+}
+
+// Verify marks the email a token was sent to as verified. It returns false
+// for unknown, used or expired tokens, when the user has since changed their
+// email, and when another account verified the same address first.
+func (svc *EmailService) Verify(ctx context.Context, token string) (bool, error) {
+	verification, err := svc.db.queries(ctx).TakeEmailVerification(ctx, token)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if verification.ExpiresAt.Before(time.Now()) {
+		return false, nil
+	}
+	n, err := svc.db.queries(ctx).VerifyEmail(ctx, model.VerifyEmailParams{
+		EmailVerifiedAt: sql.NullTime{Time: time.Now(), Valid: true},
+		ID:              verification.UserID,
+		Email:           sql.NullString{String: verification.Email, Valid: true},
+	})
+	if isUniqueViolation(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,202 @@
+package sqlite_test
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"sqlite"
+	"strings"
+	"testing"
+)
+
+type testMailer struct {
+	messages []sqlite.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg sqlite.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// token pulls the verification token out of the last message sent.
+func (m *testMailer) token(t *testing.T) string {
+	if len(m.messages) == 0 {
+		t.Fatal("expected a message")
+	}
+	body := m.messages[len(m.messages)-1].Body
+	i := strings.Index(body, "http")
+	if i == -1 {
+		t.Fatalf("expected a link in %q", body)
+	}
+	link, err := url.Parse(strings.Fields(body[i:])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestEmailService(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	authService := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+	mailer := &testMailer{}
+	svc := sqlite.NewEmailService(db, sqlite.EmailConfig{
+		Mailer:  mailer,
+		BaseURL: "https://example.com/",
+	})
+	signup := func(userName string) context.Context {
+		output, err := authService.Signup(ctx, sqlite.AuthInput{
+			UserName: userName,
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		teamUser, err := authService.GetTeamUserFromSession(ctx, output.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sqlite.ContextWithUser(ctx, teamUser)
+	}
+	login := func(email string) bool {
+		output, err := authService.Login(ctx, sqlite.AuthInput{
+			UserName: email,
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output.OK
+	}
+	verify := func(token string) bool {
+		ok, err := svc.Verify(ctx, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	alice := signup("alice")
+
+	for _, email := range []string{"alice", "Alice <alice@example.com>", "alice@", "@example.com"} {
+		if err := svc.SetEmail(alice, email); err != sqlite.ErrInvalidEmail {
+			t.Fatalf("email %q: expected ErrInvalidEmail, got %v", email, err)
+		}
+	}
+	if len(mailer.messages) != 0 {
+		t.Fatalf("expected no messages, got %d", len(mailer.messages))
+	}
+
+	if err := svc.SetEmail(alice, " Alice@Example.com "); err != nil {
+		t.Fatal(err)
+		return
+	}
+	msg := mailer.messages[0]
+	if msg.To != "alice@example.com" {
+		t.Fatalf("expected the message to go to alice@example.com, got %q", msg.To)
+	}
+	if !strings.Contains(msg.Body, "https://example.com/verify-email?token=") {
+		t.Fatalf("expected a verification link, got %q", msg.Body)
+	}
+	stale := mailer.token(t)
+	if login("alice@example.com") {
+		t.Fatal("expected login by an unverified email to fail")
+	}
+
+	// resending replaces the previous link
+	if err := svc.Resend(alice); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if verify(stale) {
+		t.Fatal("expected the replaced link to be refused")
+	}
+	token := mailer.token(t)
+	if !verify(token) {
+		t.Fatal("expected the email to be verified")
+	}
+	if verify(token) {
+		t.Fatal("expected the link to only work once")
+	}
+	if !login("ALICE@example.com") {
+		t.Fatal("expected login by email to succeed")
+	}
+	if !login("alice") {
+		t.Fatal("expected login by username to still succeed")
+	}
+
+	// nobody else can verify an address that is already taken
+	bob := signup("bob")
+	if err := svc.SetEmail(bob, "alice@example.com"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if verify(mailer.token(t)) {
+		t.Fatal("expected a verified address to not be verified twice")
+	}
+
+	// changing the address makes it unverified again
+	if err := svc.SetEmail(alice, "alice@example.org"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if login("alice@example.com") {
+		t.Fatal("expected the old email to stop working")
+	}
+	if err := svc.SetEmail(alice, ""); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if verify(mailer.token(t)) {
+		t.Fatal("expected the link for a removed email to be refused")
+	}
+
+	// only a few links are sent to a user before they have to wait
+	sent := len(mailer.messages)
+	if err := svc.SetEmail(alice, "alice@example.net"); err != sqlite.ErrTooManyEmails {
+		t.Fatalf("expected too many emails, got %v", err)
+	}
+	if len(mailer.messages) != sent {
+		t.Fatal("expected no link to be sent")
+	}
+	// and to an address, whoever asks for them
+	if err := svc.SetEmail(signup("carol"), "alice@example.com"); err != sqlite.ErrTooManyEmails {
+		t.Fatalf("expected too many emails, got %v", err)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := sqlite.FileMailer{Dir: dir, From: "dials@example.com"}
+	err := mailer.Send(context.Background(), sqlite.Message{
+		To:      "alice@example.com",
+		Subject: "Hello\r\nBcc: eve@example.com",
+		Body:    "hi",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one message, got %d", len(entries))
+	}
+	b, err := os.ReadFile(dir + "/" + entries[0].Name())
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if strings.Contains(string(b), "\r\nBcc:") {
+		t.Fatalf("expected headers to not be injectable, got %q", b)
+	}
+	if !strings.Contains(string(b), "To: alice@example.com\r\n") {
+		t.Fatalf("expected a To header, got %q", b)
+	}
+}
@@ -0,0 +1,170 @@
+package sqlite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher creates password hashes in a self-describing format, the
+// scheme and its parameters are stored alongside the hash so hashes from
+// every supported scheme can be verified whatever the current hasher is.
+type PasswordHasher interface {
+	Hash(password string) ([]byte, error)
+	// NeedsRehash reports whether a stored hash is weaker than what this
+	// hasher would produce and should be replaced on the next login.
+	NeedsRehash(hash []byte) bool
+}
+
+var DefaultPasswordHasher PasswordHasher = BcryptHasher{Cost: bcrypt.DefaultCost}
+
+// ParsePasswordHasher returns the hasher of a scheme, "bcrypt" or
+// "argon2id", with a bcrypt cost. Either may be empty for the default.
+func ParsePasswordHasher(scheme, bcryptCost string) (PasswordHasher, error) {
+	cost := bcrypt.DefaultCost
+	if bcryptCost != "" {
+		var err error
+		cost, err = strconv.Atoi(bcryptCost)
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("invalid bcrypt cost %q, expected %d to %d", bcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	}
+	switch scheme {
+	case "", "bcrypt":
+		return BcryptHasher{Cost: cost}, nil
+	case "argon2id":
+		return DefaultArgon2idHasher, nil
+	default:
+		return nil, fmt.Errorf("invalid password hash %q, expected bcrypt or argon2id", scheme)
+	}
+}
+
+// BcryptHasher stores hashes in the standard $2a$ format.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+}
+
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	// argon2id is the stronger scheme, going back to bcrypt mustn't
+	// downgrade the hashes made meanwhile
+	if bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		return false
+	}
+	if !isBcryptHash(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost < h.Cost
+}
+
+func isBcryptHash(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2a$")) ||
+		bytes.HasPrefix(hash, []byte("$2b$")) ||
+		bytes.HasPrefix(hash, []byte("$2y$"))
+}
+
+// Argon2idHasher stores hashes in the PHC string format, for example
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+type Argon2idHasher struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idHasher follows the parameters recommended by RFC 9106 for
+// memory constrained environments.
+var DefaultArgon2idHasher = Argon2idHasher{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h Argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)), nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	stored, _, key, err := parseArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+	return stored.Memory < h.Memory ||
+		stored.Iterations < h.Iterations ||
+		stored.Parallelism < h.Parallelism ||
+		uint32(len(key)) < h.KeyLength
+}
+
+func parseArgon2idHash(hash []byte) (Argon2idHasher, []byte, []byte, error) {
+	var h Argon2idHasher
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || "$"+parts[1]+"$" != argon2idPrefix {
+		return h, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return h, nil, nil, err
+	}
+	if version != argon2.Version {
+		return h, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.Memory, &h.Iterations, &h.Parallelism); err != nil {
+		return h, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return h, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return h, nil, nil, err
+	}
+	h.SaltLength = uint32(len(salt))
+	h.KeyLength = uint32(len(key))
+	return h, salt, key, nil
+}
+
+// comparePassword reports whether the password matches a hash from any
+// supported scheme. Hashes it doesn't recognise, like the empty hash of users
+// provisioned by single sign-on, never match.
+func comparePassword(hash []byte, password string) bool {
+	switch {
+	case isBcryptHash(hash):
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	case bytes.HasPrefix(hash, []byte(argon2idPrefix)):
+		h, salt, key, err := parseArgon2idHash(hash)
+		if err != nil {
+			return false
+		}
+		other := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+		return subtle.ConstantTimeCompare(key, other) == 1
+	default:
+		return false
+	}
+}
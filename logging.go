@@ -0,0 +1,103 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LogConfig says how the server logs.
+type LogConfig struct {
+	// Format is "text" for key=value lines or "json" for a JSON object per
+	// line, text by default.
+	Format string
+	// Level is the least severe level that's logged, info by default.
+	Level slog.Level
+}
+
+// ParseLogConfig parses a format and a level like "debug" or "warn", either
+// may be empty for the default.
+func ParseLogConfig(format, level string) (LogConfig, error) {
+	var config LogConfig
+	switch format {
+	case "", "text", "json":
+		config.Format = format
+	default:
+		return config, fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+	if level != "" {
+		if err := config.Level.UnmarshalText([]byte(level)); err != nil {
+			return config, fmt.Errorf("invalid log level %q: %w", level, err)
+		}
+	}
+	return config, nil
+}
+
+// NewLogger returns a logger writing to w that adds the request id of the
+// context, if any, to what's logged with it.
+func NewLogger(w io.Writer, config LogConfig) *slog.Logger {
+	options := &slog.HandlerOptions{Level: config.Level}
+	var handler slog.Handler = slog.NewTextHandler(w, options)
+	if config.Format == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a context carrying the id of the request it
+// serves.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the id of the request the context serves, or
+// "" outside of one.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID returns the X-Request-ID a proxy in front of the server set, so
+// its logs and ours can be matched, or a new one if there isn't a usable one.
+func requestID(header string) string {
+	if validRequestID(header) {
+		return header
+	}
+	b := make([]byte, 16)
+	// crypto/rand doesn't fail on the platforms we run on
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID keeps whatever a client sends from forging log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:") == ""
+}
@@ -0,0 +1,129 @@
+package sqlite_test
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sqlite"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogConfig(t *testing.T) {
+	config, err := sqlite.ParseLogConfig("json", "warn")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if config.Format != "json" || config.Level != slog.LevelWarn {
+		t.Fatalf("expected json at warn, got %+v", config)
+	}
+	if config, err := sqlite.ParseLogConfig("", ""); err != nil || config.Level != slog.LevelInfo {
+		t.Fatalf("expected text at info by default, got %+v, %v", config, err)
+	}
+	if _, err := sqlite.ParseLogConfig("xml", ""); err == nil {
+		t.Fatal("expected the format to be checked")
+	}
+	if _, err := sqlite.ParseLogConfig("", "loud"); err == nil {
+		t.Fatal("expected the level to be checked")
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var logs syncBuffer
+	previous := slog.Default()
+	slog.SetDefault(sqlite.NewLogger(&logs, sqlite.LogConfig{Format: "json"}))
+	defer func() {
+		slog.SetDefault(previous)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+	server := newTestServer(t)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	do := func(method, path, requestID string, form url.Values) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	// logged returns the lines logged for a request, once the request itself
+	// is, which happens after the response is sent
+	logged := func(requestID string) map[string]map[string]interface{} {
+		lines := map[string]map[string]interface{}{}
+		for deadline := time.Now().Add(time.Second); lines["request"] == nil && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+			for _, line := range strings.Split(logs.String(), "\n") {
+				var entry map[string]interface{}
+				if json.Unmarshal([]byte(line), &entry) == nil && entry["request_id"] == requestID {
+					lines[entry["msg"].(string)] = entry
+				}
+			}
+		}
+		if lines["request"] == nil {
+			t.Fatalf("expected request %s to be logged, got %s", requestID, logs.String())
+		}
+		return lines
+	}
+
+	// the id of a proxy in front is kept, unless it's not one
+	if res := do(http.MethodGet, "/signup", "proxy-1", nil); res.Header.Get("X-Request-ID") != "proxy-1" {
+		t.Fatalf("expected the request id to be kept, got %q", res.Header.Get("X-Request-ID"))
+	}
+	request := logged("proxy-1")["request"]
+	if request["method"] != "GET" || request["route"] != "/signup" || request["status"] != 200.0 || request["user_id"] != 0.0 || request["bytes"].(float64) == 0 {
+		t.Fatalf("expected the signup page to be logged, got %v", request)
+	}
+	res := do(http.MethodGet, "/signup", "forged msg=hello", nil)
+	if id := res.Header.Get("X-Request-ID"); len(id) != 32 || strings.Contains(id, "forged") {
+		t.Fatalf("expected a new request id, got %q", id)
+	}
+
+	serverURL, _ := url.Parse(server.URL)
+	var token string
+	for _, cookie := range jar.Cookies(serverURL) {
+		if cookie.Name == "csrf" {
+			token = cookie.Value
+		}
+	}
+	signup := url.Values{"userName": {"test"}, "password": {testPassword}, "csrf_token": {token}}
+	if res := do(http.MethodPost, "/signup", "", signup); res.StatusCode != http.StatusFound {
+		t.Fatalf("expected status 302, got %d", res.StatusCode)
+	}
+
+	// routes are logged by their pattern, with who asked
+	do(http.MethodGet, "/dials/nope", "dial-1", nil)
+	lines := logged("dial-1")
+	request = lines["request"]
+	if request["route"] != "/dials/:id" || request["status"] != 500.0 || request["user_id"].(float64) == 0 || request["team_id"].(float64) == 0 {
+		t.Fatalf("expected the dial to be logged by its route, got %v", request)
+	}
+	// and errors under the request they failed
+	if failed := lines["request failed"]; failed == nil || failed["level"] != "ERROR" || !strings.Contains(failed["err"].(string), "invalid syntax") {
+		t.Fatalf("expected the error to be logged with the request id, got %v", lines)
+	}
+}
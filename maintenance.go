@@ -0,0 +1,123 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// incrementalVacuumPages is how many free pages the incremental vacuum job
+// gives back at most per run, so the write lock isn't held for long.
+const incrementalVacuumPages = 1000
+
+// MaintenanceConfig says which of the maintenance jobs run.
+type MaintenanceConfig struct {
+	// SkipCheckpoint leaves checkpoints to SQLite's automatic ones, or to a
+	// Replicator, which checkpoints on its own and whose read transaction
+	// keeps a truncating checkpoint from finishing anyway.
+	SkipCheckpoint bool
+}
+
+// MaintenanceJobs returns the jobs that keep the database in shape, spread
+// over the quiet hours where they take a while.
+func MaintenanceJobs(db *DB, config MaintenanceConfig) []Job {
+	jobs := []Job{
+		{
+			// cheap, it only analyzes what changed enough to need it
+			Name:     "optimize",
+			Schedule: "@hourly",
+			Jitter:   5 * time.Minute,
+			Run:      db.Optimize,
+		},
+		{
+			Name:     "incremental-vacuum",
+			Schedule: "30 3 * * *",
+			Jitter:   15 * time.Minute,
+			Run: func(ctx context.Context) error {
+				_, err := db.IncrementalVacuum(ctx, incrementalVacuumPages)
+				return err
+			},
+		},
+		{
+			Name:     "analyze",
+			Schedule: "0 4 * * 0",
+			Jitter:   15 * time.Minute,
+			Run:      db.Analyze,
+		},
+	}
+	if !config.SkipCheckpoint {
+		jobs = append(jobs, Job{
+			Name:     "checkpoint",
+			Schedule: "*/15 * * * *",
+			Jitter:   time.Minute,
+			Run: func(ctx context.Context) error {
+				result, err := db.Checkpoint(ctx, "truncate")
+				if err == nil && result.Busy {
+					// not a failure, it's tried again next time
+					slog.WarnContext(ctx, "checkpoint: readers kept frames in the WAL", "kept", result.Frames-result.Checkpointed, "frames", result.Frames)
+				}
+				return err
+			},
+		})
+	}
+	return jobs
+}
+
+// Optimize runs PRAGMA optimize, which updates the statistics the query
+// planner goes by for tables that changed a lot.
+func (db *DB) Optimize(ctx context.Context) error {
+	_, err := db.db.ExecContext(ctx, `PRAGMA optimize`)
+	return err
+}
+
+// Analyze gathers the statistics of every table and index afresh.
+func (db *DB) Analyze(ctx context.Context) error {
+	_, err := db.db.ExecContext(ctx, `ANALYZE`)
+	return err
+}
+
+// IncrementalVacuum gives up to pages free pages back to the file system
+// and returns how many it gave back. Databases created before incremental
+// vacuuming was turned on have to be vacuumed once first, until then it does
+// nothing.
+func (db *DB) IncrementalVacuum(ctx context.Context, pages int) (int64, error) {
+	var mode int
+	if err := db.db.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return 0, err
+	}
+	// 2 is incremental
+	if mode != 2 {
+		return 0, nil
+	}
+	var before, after int64
+	if err := db.db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&before); err != nil {
+		return 0, err
+	}
+	// the pragma only vacuums as its rows are stepped through
+	rows, err := db.db.QueryContext(ctx, fmt.Sprintf(`PRAGMA incremental_vacuum(%d)`, pages))
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := db.db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&after); err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+// Vacuum rebuilds the database file, which also switches it to incremental
+// vacuuming. It needs as much free disk space as the database takes, and
+// locks writers out until it's done.
+func (db *DB) Vacuum(ctx context.Context) error {
+	if _, err := db.db.ExecContext(ctx, `PRAGMA auto_vacuum = incremental`); err != nil {
+		return err
+	}
+	_, err := db.db.ExecContext(ctx, `VACUUM`)
+	return err
+}
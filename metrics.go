@@ -1,7 +1,14 @@
 package sqlite
 
 import (
+	"context"
+	"database/sql"
+	"log/slog"
 	"net/http"
+	"os"
+	"sqlite/model"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,16 +23,250 @@ var (
 		},
 		[]string{"method", "path", "status"},
 	)
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "auth_failed_attempts_total",
+			Help: "Failed login, signup and password change attempts.",
+		},
+		[]string{"action", "reason"},
+	)
+	queryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "db_query_duration_seconds",
+			Help:    "Duration of database queries by their sqlc name.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9),
+		},
+		[]string{"query"},
+	)
+	queryErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_query_errors_total",
+			Help: "Database queries that failed, by their sqlc name.",
+		},
+		[]string{"query"},
+	)
+	transactionRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_transaction_retries_total",
+			Help: "Transactions tried again because the database was busy or locked.",
+		},
+		[]string{"pool"},
+	)
+	transactionBusyFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_transaction_busy_failures_total",
+			Help: "Transactions that failed because the database stayed busy or locked.",
+		},
+		[]string{"pool"},
+	)
+	backupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_backups_total",
+			Help: "Backups taken by the backup service.",
+		},
+		[]string{"result"},
+	)
+	backupDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "db_backup_duration_seconds",
+			Help:    "Duration of backups, including the integrity check.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+		},
+	)
+	backupLastSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "db_backup_last_success_timestamp_seconds",
+			Help: "When the last successful backup finished.",
+		},
+	)
+	backupSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "db_backup_size_bytes",
+			Help: "Size of the last successful backup.",
+		},
+	)
+	jobRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "job_runs_total",
+			Help: "Runs of background jobs, skipped when the last one hadn't finished.",
+		},
+		[]string{"job", "result"},
+	)
+	jobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "job_duration_seconds",
+			Help:    "Duration of background job runs.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 9),
+		},
+		[]string{"job"},
+	)
+	jobLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "job_last_success_timestamp_seconds",
+			Help: "When background jobs last finished without failing.",
+		},
+		[]string{"job"},
+	)
+	replicationSyncs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_replication_syncs_total",
+			Help: "Times the replicator shipped the WAL to the replica.",
+		},
+		[]string{"result"},
+	)
+	replicationLastSync = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "db_replication_last_sync_timestamp_seconds",
+			Help: "When the replica last caught up with the database.",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(authFailures)
+	prometheus.MustRegister(queryDuration, queryErrors)
+	prometheus.MustRegister(transactionRetries, transactionBusyFailures)
+	prometheus.MustRegister(backupsTotal, backupDuration, backupLastSuccess, backupSize)
+	prometheus.MustRegister(replicationSyncs, replicationLastSync)
+	prometheus.MustRegister(jobRuns, jobDuration, jobLastSuccess)
+}
+
+// DBCollector reports the health of the database file and its connection
+// pools. The file is only looked at on scrape, and at most once per TTL.
+type DBCollector struct {
+	db  *DB
+	ttl time.Duration
+
+	mu          sync.Mutex
+	collectedAt time.Time
+	cached      []prometheus.Metric
+}
+
+var (
+	dbUpDesc            = prometheus.NewDesc("db_up", "Whether the database could be looked at on the last scrape.", nil, nil)
+	dbPagesDesc         = prometheus.NewDesc("db_pages", "Pages in the database file.", nil, nil)
+	dbFreelistPagesDesc = prometheus.NewDesc("db_freelist_pages", "Unused pages in the database file, a vacuum would free them.", nil, nil)
+	dbSizeDesc          = prometheus.NewDesc("db_size_bytes", "Size of the database file.", nil, nil)
+	dbWALSizeDesc       = prometheus.NewDesc("db_wal_size_bytes", "Size of the WAL file.", nil, nil)
+	dbTableRowsDesc     = prometheus.NewDesc("db_table_rows", "Rows in each table.", []string{"table"}, nil)
+
+	dbCheckpointBusyDesc         = prometheus.NewDesc("db_last_checkpoint_busy", "Whether readers or writers kept the last checkpoint from finishing.", []string{"mode"}, nil)
+	dbCheckpointFramesDesc       = prometheus.NewDesc("db_last_checkpoint_wal_frames", "Frames in the WAL at the last checkpoint.", []string{"mode"}, nil)
+	dbCheckpointCheckpointedDesc = prometheus.NewDesc("db_last_checkpoint_checkpointed_frames", "Frames the last checkpoint copied into the database.", []string{"mode"}, nil)
+	dbCheckpointTimeDesc         = prometheus.NewDesc("db_last_checkpoint_timestamp_seconds", "When the last checkpoint ran.", []string{"mode"}, nil)
+
+	dbPoolOpenDesc         = prometheus.NewDesc("db_pool_open_connections", "Open connections of the pool.", []string{"pool"}, nil)
+	dbPoolInUseDesc        = prometheus.NewDesc("db_pool_in_use_connections", "Connections of the pool in use.", []string{"pool"}, nil)
+	dbPoolIdleDesc         = prometheus.NewDesc("db_pool_idle_connections", "Idle connections of the pool.", []string{"pool"}, nil)
+	dbPoolWaitCountDesc    = prometheus.NewDesc("db_pool_waits_total", "Times a connection of the pool was waited for.", []string{"pool"}, nil)
+	dbPoolWaitDurationDesc = prometheus.NewDesc("db_pool_wait_seconds_total", "Time spent waiting for connections of the pool.", []string{"pool"}, nil)
+)
+
+// NewDBCollector returns a collector for db, to be registered once per
+// database. ttl is how long what it found in the file is reused, a minute
+// if zero, as counting the rows of every table isn't free.
+func NewDBCollector(db *DB, ttl time.Duration) *DBCollector {
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	return &DBCollector{db: db, ttl: ttl}
+}
+
+func (c *DBCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		dbUpDesc, dbPagesDesc, dbFreelistPagesDesc, dbSizeDesc, dbWALSizeDesc, dbTableRowsDesc,
+		dbCheckpointBusyDesc, dbCheckpointFramesDesc, dbCheckpointCheckpointedDesc, dbCheckpointTimeDesc,
+		dbPoolOpenDesc, dbPoolInUseDesc, dbPoolIdleDesc, dbPoolWaitCountDesc, dbPoolWaitDurationDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *DBCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	if c.cached == nil || time.Since(c.collectedAt) >= c.ttl {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		c.cached = c.collectFile(ctx)
+		cancel()
+		c.collectedAt = time.Now()
+	}
+	for _, metric := range c.cached {
+		ch <- metric
+	}
+	c.mu.Unlock()
+
+	// the rest is cheap and changes by the second
+	c.db.mu.Lock()
+	checkpoint := c.db.lastCheckpoint
+	c.db.mu.Unlock()
+	if !checkpoint.At.IsZero() {
+		busy := 0.0
+		if checkpoint.Busy {
+			busy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(dbCheckpointBusyDesc, prometheus.GaugeValue, busy, checkpoint.Mode)
+		ch <- prometheus.MustNewConstMetric(dbCheckpointFramesDesc, prometheus.GaugeValue, float64(checkpoint.Frames), checkpoint.Mode)
+		ch <- prometheus.MustNewConstMetric(dbCheckpointCheckpointedDesc, prometheus.GaugeValue, float64(checkpoint.Checkpointed), checkpoint.Mode)
+		ch <- prometheus.MustNewConstMetric(dbCheckpointTimeDesc, prometheus.GaugeValue, float64(checkpoint.At.UnixNano())/1e9, checkpoint.Mode)
+	}
+	pools := map[string]*sql.DB{"write": c.db.db}
+	if c.db.read != c.db.db {
+		pools["read"] = c.db.read
+	}
+	for pool, db := range pools {
+		stats := db.Stats()
+		ch <- prometheus.MustNewConstMetric(dbPoolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolInUseDesc, prometheus.GaugeValue, float64(stats.InUse), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolIdleDesc, prometheus.GaugeValue, float64(stats.Idle), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount), pool)
+		ch <- prometheus.MustNewConstMetric(dbPoolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds(), pool)
+	}
+}
+
+// collectFile looks at the database file, db_up says whether it could.
+func (c *DBCollector) collectFile(ctx context.Context) []prometheus.Metric {
+	var pages, freelist, pageSize int64
+	err := c.db.read.QueryRowContext(ctx, `select page_count, freelist_count, page_size from pragma_page_count(), pragma_freelist_count(), pragma_page_size()`).Scan(&pages, &freelist, &pageSize)
+	var walSize int64
+	if err == nil {
+		var file string
+		if file, err = c.db.file(ctx); err == nil && file != "" {
+			info, statErr := os.Stat(file + "-wal")
+			if statErr == nil {
+				walSize = info.Size()
+			} else if !os.IsNotExist(statErr) {
+				err = statErr
+			}
+		}
+	}
+	var tables []TableSize
+	if err == nil {
+		tables, err = c.db.TableSizes(ctx)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot collect db metrics", "err", err)
+		return []prometheus.Metric{prometheus.MustNewConstMetric(dbUpDesc, prometheus.GaugeValue, 0)}
+	}
+	metrics := []prometheus.Metric{
+		prometheus.MustNewConstMetric(dbUpDesc, prometheus.GaugeValue, 1),
+		prometheus.MustNewConstMetric(dbPagesDesc, prometheus.GaugeValue, float64(pages)),
+		prometheus.MustNewConstMetric(dbFreelistPagesDesc, prometheus.GaugeValue, float64(freelist)),
+		prometheus.MustNewConstMetric(dbSizeDesc, prometheus.GaugeValue, float64(pages*pageSize)),
+		prometheus.MustNewConstMetric(dbWALSizeDesc, prometheus.GaugeValue, float64(walSize)),
+	}
+	for _, table := range tables {
+		metrics = append(metrics, prometheus.MustNewConstMetric(dbTableRowsDesc, prometheus.GaugeValue, float64(table.Rows), table.Name))
+	}
+	return metrics
 }
 
 type instrumentedResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
 	path       string
+	bytes      int64
+	user       model.TeamUser
 }
 
 func (rec *instrumentedResponseWriter) WriteHeader(code int) {
@@ -33,21 +274,48 @@ func (rec *instrumentedResponseWriter) WriteHeader(code int) {
 	rec.ResponseWriter.WriteHeader(code)
 }
 
+func (rec *instrumentedResponseWriter) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
 func (rec *instrumentedResponseWriter) WritePath(path string) {
 	rec.path = path
 }
 
+// WriteUser records who made the request, which only the handlers inside the
+// auth middleware know.
+func (rec *instrumentedResponseWriter) WriteUser(user model.TeamUser) {
+	rec.user = user
+}
+
+// instrumentedHandler measures every request and logs it, under the request
+// id it puts in the context for the logs of everything the request does.
 func instrumentedHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r.Header.Get("X-Request-ID"))
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(ContextWithRequestID(r.Context(), id))
 		rec := &instrumentedResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		path := r.URL.Path
-		timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
+		start := time.Now()
+		defer func() {
+			elapsed := time.Since(start)
+			path := r.URL.Path
 			if rec.path != "" {
 				path = rec.path
 			}
-			requestDuration.WithLabelValues(r.Method, path, http.StatusText(rec.statusCode)).Observe(v)
-		}))
-		defer timer.ObserveDuration()
+			requestDuration.WithLabelValues(r.Method, path, http.StatusText(rec.statusCode)).Observe(elapsed.Seconds())
+			slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("method", r.Method),
+				slog.String("route", path),
+				slog.Int("status", rec.statusCode),
+				slog.Duration("duration", elapsed),
+				slog.Int64("user_id", rec.user.UserID),
+				slog.Int64("team_id", rec.user.TeamID),
+				slog.Int64("bytes", rec.bytes),
+			)
+		}()
 		handler.ServeHTTP(rec, r)
 	})
 }
@@ -94,6 +362,7 @@ func (r *InstrumentedRouter) Handle(method, path string, handle httprouter.Handl
 	r.Router.HandlerFunc(method, path, func(w http.ResponseWriter, r *http.Request) {
 		if rec, ok := w.(*instrumentedResponseWriter); ok {
 			rec.WritePath(path)
+			rec.WriteUser(UserFromFromContext(r.Context()))
 		}
 		handle(w, r, httprouter.ParamsFromContext(r.Context()))
 	})
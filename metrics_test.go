@@ -0,0 +1,87 @@
+package sqlite_test
+
+import (
+	"context"
+	"path/filepath"
+	"sqlite"
+	"sqlite/model"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather returns the values of the registry's metrics by name and the value
+// of their first label, if any.
+func gather(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName()
+			if labels := metric.GetLabel(); len(labels) > 0 {
+				name += "/" + labels[0].GetValue()
+			}
+			switch {
+			case metric.Gauge != nil:
+				values[name] = metric.GetGauge().GetValue()
+			case metric.Counter != nil:
+				values[name] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestDBCollector(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	createUser := func(name string) {
+		if _, err := db.Queries.CreateUser(ctx, model.CreateUserParams{UserName: name, UserNameSkeleton: name, Password: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createUser("foo")
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(sqlite.NewDBCollector(db, time.Hour))
+
+	values := gather(t, registry)
+	if values["db_up"] != 1 || values["db_table_rows/user"] != 1 || values["db_pages"] == 0 || values["db_wal_size_bytes"] == 0 {
+		t.Fatalf("expected the database to be looked at, got %v", values)
+	}
+	if values["db_pool_open_connections/write"] != 1 {
+		t.Fatalf("expected the write connection to be open, got %v", values)
+	}
+	if _, ok := values["db_last_checkpoint_timestamp_seconds/truncate"]; ok {
+		t.Fatalf("expected no checkpoint yet, got %v", values)
+	}
+
+	// the file is looked at once per TTL, the checkpoint right away
+	createUser("bar")
+	if _, err := db.Checkpoint(ctx, "truncate"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	values = gather(t, registry)
+	if values["db_table_rows/user"] != 1 {
+		t.Fatalf("expected the row counts to be cached, got %v", values["db_table_rows/user"])
+	}
+	if values["db_last_checkpoint_timestamp_seconds/truncate"] == 0 || values["db_last_checkpoint_busy/truncate"] != 0 {
+		t.Fatalf("expected the checkpoint to be reported, got %v", values)
+	}
+
+	fresh := prometheus.NewPedanticRegistry()
+	fresh.MustRegister(sqlite.NewDBCollector(db, time.Hour))
+	values = gather(t, fresh)
+	if values["db_table_rows/user"] != 2 || values["db_wal_size_bytes"] != 0 {
+		t.Fatalf("expected 2 users and the WAL truncated, got %v", values)
+	}
+}
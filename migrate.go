@@ -0,0 +1,429 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed db/migrations/*.sql
+var migrationFS embed.FS
+
+// Migration files are split into sections by these markers, the format of
+// sql-migrate, which sqlc understands and reads only the up section of.
+// Files without markers are all up and can't be rolled back.
+const (
+	upMarker   = "-- +migrate Up"
+	downMarker = "-- +migrate Down"
+)
+
+type migration struct {
+	// name is the path in migrationFS, or the registered name of a Go
+	// migration, it's what the migrations table records
+	name string
+	up   string
+	down string
+	// upFunc and downFunc replace up and down for Go migrations
+	upFunc   MigrationFunc
+	downFunc MigrationFunc
+}
+
+// checksum identifies the up section, the only part that has been run
+// against the database. Editing the down section isn't drift. Go code can't
+// be hashed, so Go migrations are identified by their name alone.
+func (m migration) checksum() string {
+	content := m.up
+	if m.upFunc != nil {
+		content = m.name
+	}
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m migration) reversible() bool {
+	return m.down != "" || m.downFunc != nil
+}
+
+// version is the timestamp the file name starts with.
+func (m migration) version() string {
+	version, _, _ := strings.Cut(path.Base(m.name), "_")
+	return version
+}
+
+func parseMigration(name string, buf []byte) migration {
+	m := migration{name: name}
+	var up, down strings.Builder
+	section := &up
+	for _, line := range strings.SplitAfter(string(buf), "\n") {
+		switch strings.TrimSpace(line) {
+		case upMarker:
+			section = &up
+		case downMarker:
+			section = &down
+		default:
+			section.WriteString(line)
+		}
+	}
+	m.up = up.String()
+	m.down = strings.TrimSpace(down.String())
+	return m
+}
+
+// MigrationFunc is a migration written in Go, for data changes SQL can't
+// express. It runs in the same transaction that records it as applied.
+type MigrationFunc func(ctx context.Context, tx *sql.Tx) error
+
+var goMigrations = map[string]migration{}
+
+// RegisterMigration adds a Go migration, usually from an init function. The
+// name is a version and a description like the SQL files, the version orders
+// it among them. down may be nil if the migration can't be rolled back.
+// It panics if the name is malformed or already registered.
+func RegisterMigration(name string, up, down MigrationFunc) {
+	if up == nil {
+		panic("sqlite: RegisterMigration up is nil")
+	}
+	m := migration{name: name, upFunc: up, downFunc: down}
+	if m.version() == "" || strings.Trim(m.version(), "0123456789") != "" || m.version() == name {
+		panic("sqlite: RegisterMigration name must start with a version: " + name)
+	}
+	if _, dup := goMigrations[name]; dup {
+		panic("sqlite: RegisterMigration called twice for " + name)
+	}
+	goMigrations[name] = m
+}
+
+// loadMigrations returns every embedded and registered migration, oldest
+// first.
+func loadMigrations() ([]migration, error) {
+	names, err := fs.Glob(migrationFS, "db/migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("cannot load migration files: %w", err)
+	}
+	migrations := make([]migration, 0, len(names)+len(goMigrations))
+	for _, name := range names {
+		buf, err := fs.ReadFile(migrationFS, name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, parseMigration(name, buf))
+	}
+	for _, m := range goMigrations {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return path.Base(migrations[i].name) < path.Base(migrations[j].name)
+	})
+	return migrations, nil
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt sql.NullTime
+}
+
+// appliedMigrations returns the rows of the migrations table by name.
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[string]appliedMigration, error) {
+	if _, err := db.ExecContext(ctx, `create table if not exists migrations (name text primary key);`); err != nil {
+		return nil, fmt.Errorf("cannot create migrations table: %w", err)
+	}
+	// tables created before checksums were recorded are upgraded in place,
+	// their rows get a checksum the next time Migrate runs
+	var hasChecksum bool
+	if err := db.QueryRowContext(ctx, `select count(*) > 0 from pragma_table_info('migrations') where name = 'checksum'`).Scan(&hasChecksum); err != nil {
+		return nil, fmt.Errorf("cannot inspect migrations table: %w", err)
+	}
+	if !hasChecksum {
+		if _, err := db.ExecContext(ctx, `
+			alter table migrations add column checksum text not null default '';
+			alter table migrations add column applied_at datetime;
+		`); err != nil {
+			return nil, fmt.Errorf("cannot upgrade migrations table: %w", err)
+		}
+	}
+
+	// get all saved migrations from DB and build a map
+	rows, err := db.QueryContext(ctx, `select name, checksum, applied_at from migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load migrations table: %w", err)
+	}
+	defer rows.Close()
+	applied := map[string]appliedMigration{}
+	for rows.Next() {
+		var name string
+		var m appliedMigration
+		if err = rows.Scan(&name, &m.checksum, &m.appliedAt); err != nil {
+			return nil, fmt.Errorf("cannot scan migration row: %w", err)
+		}
+
+		applied[name] = m
+	}
+	return applied, rows.Err()
+}
+
+// ErrMigrationDrift is returned by Migrate when applied migrations were
+// edited or are missing from this build.
+var ErrMigrationDrift = errors.New("applied migrations have drifted")
+
+type MigrationDrift struct {
+	Name string
+	// Missing is true when the migration was applied but isn't embedded in
+	// this build, otherwise its file changed after it was applied.
+	Missing bool
+}
+
+func (d MigrationDrift) String() string {
+	if d.Missing {
+		return d.Name + " was applied but is missing from this build"
+	}
+	return d.Name + " changed after it was applied"
+}
+
+func findDrift(applied map[string]appliedMigration, migrations []migration) []MigrationDrift {
+	var drift []MigrationDrift
+	embedded := map[string]bool{}
+	for _, m := range migrations {
+		embedded[m.name] = true
+		if a, ok := applied[m.name]; ok && a.checksum != "" && a.checksum != m.checksum() {
+			drift = append(drift, MigrationDrift{Name: m.name})
+		}
+	}
+	for name := range applied {
+		if !embedded[name] {
+			drift = append(drift, MigrationDrift{Name: name, Missing: true})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Name < drift[j].Name })
+	return drift
+}
+
+// Drift compares the applied migrations against the embedded files.
+func (db *DB) Drift(ctx context.Context) ([]MigrationDrift, error) {
+	applied, err := appliedMigrations(ctx, db.db)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return findDrift(applied, migrations), nil
+}
+
+type MigrateConfig struct {
+	// WarnOnDrift logs drift and migrates anyway instead of refusing to.
+	WarnOnDrift bool
+	// Backup is where the database is backed up to before any migration is
+	// applied.
+	Backup BackupConfig
+	// SkipBackup migrates without backing up first.
+	SkipBackup bool
+}
+
+// Migrate applies every pending migration after checking the applied ones
+// haven't drifted, and backs the database up first if there are any.
+func (db *DB) Migrate(ctx context.Context, config MigrateConfig) error {
+	applied, err := appliedMigrations(ctx, db.db)
+	if err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		// trust files applied before checksums were recorded as they are now
+		if a, ok := applied[m.name]; ok && a.checksum == "" {
+			if _, err := db.db.ExecContext(ctx, `update migrations set checksum = ? where name = ?`, m.checksum(), m.name); err != nil {
+				return fmt.Errorf("cannot record checksum of %s: %w", m.name, err)
+			}
+			a.checksum = m.checksum()
+			applied[m.name] = a
+		}
+	}
+	if drift := findDrift(applied, migrations); len(drift) > 0 {
+		if !config.WarnOnDrift {
+			return fmt.Errorf("%w: %s", ErrMigrationDrift, drift[0])
+		}
+		for _, d := range drift {
+			slog.WarnContext(ctx, "migration drift", "drift", d)
+		}
+	}
+	// run only migrations that aren't already saved in the DB
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.name]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	// a brand-new database has nothing worth backing up
+	if len(pending) > 0 && len(applied) > 0 && !config.SkipBackup {
+		path, err := db.Snapshot(ctx, config.Backup)
+		if err != nil {
+			return fmt.Errorf("cannot back up before migrating: %w", err)
+		}
+		if path != "" {
+			slog.InfoContext(ctx, "backed up before migrating", "path", path)
+		}
+	}
+	for _, m := range pending {
+		if err = applyMigration(ctx, db.db, m); err != nil {
+			return fmt.Errorf("cannot migrate file %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	slog.InfoContext(ctx, "applying migration", "migration", m.name)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.upFunc != nil {
+		err = m.upFunc(ctx, tx)
+	} else {
+		_, err = tx.ExecContext(ctx, m.up)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Insert record into migrations to prevent re-running migration.
+	if _, err := tx.ExecContext(ctx, `insert into migrations (name, checksum, applied_at) values (?, ?, ?)`, m.name, m.checksum(), time.Now().UTC()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Rollback reverts every applied migration newer than version, newest first,
+// by running their down sections. A version of 0 reverts everything, which
+// fails like any rollback reaching a migration without a down section.
+func (db *DB) Rollback(ctx context.Context, version string) error {
+	applied, err := appliedMigrations(ctx, db.db)
+	if err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	known := version == "0"
+	var revert []migration
+	for _, m := range migrations {
+		if m.version() == version {
+			known = true
+		}
+		if _, ok := applied[m.name]; ok && m.version() > version {
+			revert = append(revert, m)
+		}
+		delete(applied, m.name)
+	}
+	if !known {
+		return fmt.Errorf("no migration with version %s", version)
+	}
+	// anything left was applied by a build that had files this one doesn't,
+	// there's no way to revert it
+	for name := range applied {
+		if (migration{name: name}).version() > version {
+			return fmt.Errorf("cannot roll back %s, it isn't embedded in this build", name)
+		}
+	}
+	// check every step can be reverted before reverting any of them
+	for _, m := range revert {
+		if !m.reversible() {
+			return fmt.Errorf("cannot roll back %s, it has no down section", m.name)
+		}
+	}
+	for i := len(revert) - 1; i >= 0; i-- {
+		if err := revertMigration(ctx, db.db, revert[i]); err != nil {
+			return fmt.Errorf("cannot roll back %s: %w", revert[i].name, err)
+		}
+	}
+	return nil
+}
+
+func revertMigration(ctx context.Context, db *sql.DB, m migration) error {
+	slog.InfoContext(ctx, "rolling back migration", "migration", m.name)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.downFunc != nil {
+		err = m.downFunc(ctx, tx)
+	} else {
+		_, err = tx.ExecContext(ctx, m.down)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `delete from migrations where name = ?`, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type MigrationStatus struct {
+	Name      string
+	Version   string
+	Applied   bool
+	AppliedAt time.Time
+	// Reversible is whether the migration has a down section or function.
+	Reversible bool
+	// Changed is whether the file changed after it was applied.
+	Changed bool
+	// Missing is whether it was applied but isn't embedded in this build.
+	Missing bool
+}
+
+// MigrationStatus lists every embedded migration, oldest first, and whether
+// it has been applied. Migrations missing from this build come last.
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(ctx, db.db)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		a, ok := applied[m.name]
+		statuses = append(statuses, MigrationStatus{
+			Name:       path.Base(m.name),
+			Version:    m.version(),
+			Applied:    ok,
+			AppliedAt:  a.appliedAt.Time,
+			Reversible: m.reversible(),
+			Changed:    ok && a.checksum != "" && a.checksum != m.checksum(),
+		})
+	}
+	for _, d := range findDrift(applied, migrations) {
+		if d.Missing {
+			statuses = append(statuses, MigrationStatus{
+				Name:      path.Base(d.Name),
+				Version:   (migration{name: d.Name}).version(),
+				Applied:   true,
+				AppliedAt: applied[d.Name].appliedAt.Time,
+				Missing:   true,
+			})
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,289 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sqlite"
+	"sqlite/model"
+	"strings"
+	"testing"
+)
+
+func TestMigrateRollback(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	signup := func(userName string) {
+		_, err := sqlite.NewAuthService(db, sqlite.AuthConfig{}).Signup(ctx, sqlite.AuthInput{
+			UserName: userName,
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// down sections have to cope with rows in the tables
+	signup("alice")
+	pending := func() int {
+		statuses, err := db.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, status := range statuses {
+			if !status.Applied {
+				n++
+			}
+		}
+		return n
+	}
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(statuses) < 2 || pending() != 0 {
+		t.Fatalf("expected every migration to be applied, got %+v", statuses)
+	}
+	// the first migrations predate down sections and are left as they were
+	// applied
+	const baseline = "20240919031004"
+	for _, status := range statuses {
+		if status.Reversible != (status.Version > baseline) {
+			t.Errorf("expected only migrations after the baseline to have a down section, got %+v", status)
+		}
+	}
+
+	if err := db.Rollback(ctx, "1"); err == nil {
+		t.Fatal("expected rolling back to an unknown version to fail")
+	}
+
+	// roll back the newest migration only
+	if err := db.Rollback(ctx, statuses[len(statuses)-2].Version); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if pending() != 1 {
+		t.Fatalf("expected one pending migration, got %d", pending())
+	}
+
+	// nothing is reverted unless everything asked for can be
+	if err := db.Rollback(ctx, "0"); err == nil {
+		t.Fatal("expected rolling back the baseline to fail")
+	}
+	if pending() != 1 {
+		t.Fatalf("expected one pending migration, got %d", pending())
+	}
+
+	// every down section has to undo its up section cleanly for a round trip
+	// to the baseline to work
+	if err := db.Rollback(ctx, baseline); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if pending() != len(statuses)-3 {
+		t.Fatalf("expected every migration after the baseline to be pending, got %d", pending())
+	}
+	if _, err := db.Queries.GetLoginAttempt(ctx, "ip:127.0.0.1"); err == nil || err == sql.ErrNoRows {
+		t.Fatalf("expected the login_attempt table to be gone, got %v", err)
+	}
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if pending() != 0 {
+		t.Fatalf("expected every migration to be applied again, got %d pending", pending())
+	}
+	signup("bob")
+}
+
+func TestMigrateDrift(t *testing.T) {
+	ctx := context.Background()
+	dsn := filepath.Join(t.TempDir(), "test.db")
+	db, err := sqlite.CreateAndMigrateDb(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	db.Close()
+	// a second connection plays the part of someone editing history
+	raw, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer raw.Close()
+	exec := func(query string) {
+		if _, err := raw.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses := func(db *sqlite.DB) map[string]sqlite.MigrationStatus {
+		list, err := db.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byName := map[string]sqlite.MigrationStatus{}
+		for _, status := range list {
+			byName[status.Name] = status
+		}
+		return byName
+	}
+
+	exec(`update migrations set checksum = 'edited' where name = 'db/migrations/20240906162109_dial.sql'`)
+	if _, err := sqlite.CreateAndMigrateDb(ctx, dsn); !errors.Is(err, sqlite.ErrMigrationDrift) {
+		t.Fatalf("expected ErrMigrationDrift, got %v", err)
+	}
+	db, err = sqlite.OpenDb(ctx, dsn, sqlite.DBConfig{})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{WarnOnDrift: true}); err != nil {
+		t.Fatalf("expected drift to only warn, got %v", err)
+	}
+	if status := statuses(db)["20240906162109_dial.sql"]; !status.Changed {
+		t.Fatalf("expected the dial migration to be changed, got %+v", status)
+	}
+
+	exec(`insert into migrations(name, checksum) values('db/migrations/29990101000000_future.sql', 'future')`)
+	drift, err := db.Drift(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(drift) != 2 || drift[0].Missing || !drift[1].Missing {
+		t.Fatalf("expected a changed and a missing migration, got %v", drift)
+	}
+	if status := statuses(db)["29990101000000_future.sql"]; !status.Missing || !status.Applied {
+		t.Fatalf("expected the future migration to be missing, got %+v", status)
+	}
+
+	// tables from before checksums are upgraded and trusted as they are
+	exec(`drop table migrations`)
+	exec(`create table migrations (name text primary key)`)
+	exec(`insert into migrations(name) values('db/migrations/20240831143625_user.sql')`)
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{}); err == nil {
+		t.Fatal("expected the rest of the migrations to fail on existing tables")
+	}
+	exec(`delete from migrations`)
+	for name, status := range statuses(db) {
+		// Go migrations are recorded by their registered name
+		if strings.HasSuffix(name, ".sql") {
+			name = "db/migrations/" + name
+		}
+		exec(fmt.Sprintf(`insert into migrations(name) values('%s')`, name))
+		if status.Applied {
+			t.Fatalf("expected %s to be pending", name)
+		}
+	}
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	for name, status := range statuses(db) {
+		if !status.Applied || status.Changed {
+			t.Fatalf("expected %s to be applied and unchanged, got %+v", name, status)
+		}
+	}
+}
+
+func TestGoMigration(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	// Go migrations are ordered among the SQL files by their version
+	var before string
+	for i, status := range statuses {
+		if status.Name == "20261019190000_normalize_user_name_skeleton.go" {
+			if !status.Applied || !status.Reversible || i == 0 {
+				t.Fatalf("expected the Go migration to be applied and reversible, got %+v", status)
+			}
+			before = statuses[i-1].Version
+		}
+	}
+	if before == "" {
+		t.Fatalf("expected the Go migration in the status, got %+v", statuses)
+	}
+
+	if err := db.Rollback(ctx, before); err != nil {
+		t.Fatal(err)
+		return
+	}
+	// a user from before usernames were normalized, with the skeleton the SQL
+	// backfill gave them
+	_, err = db.Queries.CreateUser(ctx, model.CreateUserParams{
+		UserName:         "ｍａｒｉａ",
+		UserNameSkeleton: "ｍａｒｉａ",
+		Password:         []byte("hash"),
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if taken, err := db.Queries.UsernameSkeletonExists(ctx, "marla"); err != nil || taken != 1 {
+		t.Fatalf("expected the skeleton to be normalized, got %v %v", taken, err)
+	}
+}
+
+func TestUniqueUsernameSkeleton(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	if err := db.Rollback(ctx, "20261019210000"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	// lookalikes that signed up before they were refused
+	for _, userName := range []string{"jane.doe", "janedoe"} {
+		_, err := db.Queries.CreateUser(ctx, model.CreateUserParams{
+			UserName:         userName,
+			UserNameSkeleton: "janedoe",
+			Password:         []byte("hash"),
+		})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if _, err := db.Queries.GetUserByUsername(ctx, "janedoe"); err != nil {
+		t.Fatalf("expected the lookalike to keep their name, got %v", err)
+	}
+	_, err = db.Queries.CreateUser(ctx, model.CreateUserParams{
+		UserName:         "jane_doe",
+		UserNameSkeleton: "janedoe",
+		Password:         []byte("hash"),
+	})
+	if err == nil {
+		t.Fatal("expected the skeleton to be unique")
+	}
+}
@@ -0,0 +1,71 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Go migrations work on the schema as it was when they were written, so they
+// use plain SQL rather than the generated queries, which follow the latest
+// schema. For the same reason they keep a copy of any rule they apply, like
+// how usernames are normalized, rather than call code that may change later
+// and give databases migrated at different times different data.
+func init() {
+	RegisterMigration("20261019190000_normalize_user_name_skeleton.go", normalizeUserNameSkeletons, nothingToUndo)
+}
+
+// nothingToUndo is the down function of data fixes that leave the data valid
+// for older schemas too.
+func nothingToUndo(ctx context.Context, tx *sql.Tx) error {
+	return nil
+}
+
+// normalizeUserNameSkeletons recomputes every skeleton from the normalized
+// username. The SQL backfill in 20261019150000_user_name_skeleton.sql
+// couldn't normalize usernames first, and signups before normalization only
+// lowercased them, so users with compatibility characters (like fullwidth
+// letters) or surrounding spaces got skeletons that matched nothing.
+// There's nothing to undo, the skeletons are only more correct.
+func normalizeUserNameSkeletons(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `select id, user_name from user`)
+	if err != nil {
+		return err
+	}
+	skeletons := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var userName string
+		if err := rows.Scan(&id, &userName); err != nil {
+			rows.Close()
+			return err
+		}
+		skeletons[id] = skeleton20261019190000(userName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, skeleton := range skeletons {
+		if _, err := tx.ExecContext(ctx, `update user set user_name_skeleton = ? where id = ?`, skeleton, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skeleton20261019190000 is NormalizeUsername then usernameSkeleton as they
+// were when normalizeUserNameSkeletons was written.
+func skeleton20261019190000(userName string) string {
+	userName = strings.ToLower(strings.TrimSpace(norm.NFKC.String(userName)))
+	for _, r := range [][2]string{
+		{".", ""}, {"-", ""}, {"_", ""},
+		{"0", "o"}, {"1", "l"}, {"i", "l"},
+		{"rn", "m"}, {"vv", "w"},
+	} {
+		userName = strings.ReplaceAll(userName, r[0], r[1])
+	}
+	return userName
+}
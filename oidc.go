@@ -0,0 +1,226 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"sqlite/model"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// UsernameClaim is the ID token claim used as the local username,
+	// preferred_username when empty.
+	UsernameClaim string
+	// Team is the name of the team new users are provisioned into, created
+	// for the first of them. When empty every new user gets their own team,
+	// the same as Signup.
+	Team string
+}
+
+type OIDCService struct {
+	db       *DB
+	config   OIDCConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCService discovers the provider's endpoints from its issuer URL.
+func NewOIDCService(ctx context.Context, db *DB, config OIDCConfig) (*OIDCService, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	return &OIDCService{
+		db:     db,
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL starts an authorization code flow with PKCE and returns the
+// provider URL to send the browser to along with its state.
+func (svc *OIDCService) AuthCodeURL(ctx context.Context, next string) (string, string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+	err = svc.db.queries(ctx).CreateOIDCState(ctx, model.CreateOIDCStateParams{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		Next:         next,
+		ExpiresAt:    time.Now().Add(10 * time.Minute),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	url := svc.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	return url, state, nil
+}
+
+// Callback finishes the flow started by AuthCodeURL. Users seen for the first
+// time are provisioned, and the session issued is the same as
+// AuthService.Login. The next value given to AuthCodeURL is returned.
+func (svc *OIDCService) Callback(ctx context.Context, state, code string) (AuthOutput, string, error) {
+	pending, err := svc.db.queries(ctx).TakeOIDCState(ctx, state)
+	if err != nil {
+		// an unknown state was either already used or never issued by us
+		if err == sql.ErrNoRows {
+			return AuthOutput{OK: false}, "", nil
+		}
+		return AuthOutput{}, "", err
+	}
+	if pending.ExpiresAt.Before(time.Now()) {
+		return AuthOutput{OK: false}, "", nil
+	}
+
+	token, err := svc.oauth2.Exchange(ctx, code, oauth2.VerifierOption(pending.CodeVerifier))
+	if err != nil {
+		return AuthOutput{OK: false}, "", nil
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return AuthOutput{OK: false}, "", nil
+	}
+	idToken, err := svc.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return AuthOutput{OK: false}, "", nil
+	}
+	if idToken.Nonce != pending.Nonce {
+		return AuthOutput{OK: false}, "", nil
+	}
+
+	userID, err := svc.db.queries(ctx).GetOIDCIdentity(ctx, model.GetOIDCIdentityParams{
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+	})
+	if err == sql.ErrNoRows {
+		var claims map[string]interface{}
+		if err := idToken.Claims(&claims); err != nil {
+			return AuthOutput{}, "", err
+		}
+		userName, _ := claims[svc.config.UsernameClaim].(string)
+		userID, err = svc.provision(ctx, idToken, userName)
+	}
+	if err != nil {
+		if err == errUsernameUnavailable || err == errUsernameClaimed {
+			return AuthOutput{OK: false}, "", nil
+		}
+		return AuthOutput{}, "", err
+	}
+
+	teamUser, err := svc.db.queries(ctx).GetDefaultTeamUser(ctx, userID)
+	if err != nil {
+		return AuthOutput{}, "", err
+	}
+	sessionToken, err := createSession(ctx, svc.db.queries(ctx), teamUser.ID)
+	if err == errAccountDisabled {
+		return AuthOutput{OK: false}, "", nil
+	}
+	if err != nil {
+		return AuthOutput{}, "", err
+	}
+	return AuthOutput{
+		Token: sessionToken,
+		OK:    true,
+	}, pending.Next, nil
+}
+
+var errUsernameUnavailable = errors.New("username unavailable")
+
+// provision creates a local user linked to the identity. A username that is
+// already claimed by a local account is never linked automatically, that
+// would let the provider take over the account.
+func (svc *OIDCService) provision(ctx context.Context, idToken *oidc.IDToken, userName string) (int64, error) {
+	userName, problems := CheckUsername(userName)
+	if len(problems) > 0 {
+		return 0, errUsernameUnavailable
+	}
+	var userID int64
+	err := svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		var err error
+		// an empty hash never matches, and changing the password needs the
+		// current one, so these users only ever log in through the provider
+		userID, err = createUser(ctx, q, userName, []byte{})
+		if err != nil {
+			return err
+		}
+		err = q.CreateOIDCIdentity(ctx, model.CreateOIDCIdentityParams{
+			UserID:  userID,
+			Issuer:  idToken.Issuer,
+			Subject: idToken.Subject,
+		})
+		if err != nil {
+			return err
+		}
+		teamID, err := svc.provisionTeam(ctx, q, userName)
+		if err != nil {
+			return err
+		}
+		tuID, err := q.CreateTeamUser(ctx, model.CreateTeamUserParams{
+			TeamID: teamID,
+			UserID: userID,
+		})
+		if err != nil {
+			return err
+		}
+		return q.SetDefaultTeamUser(ctx, model.SetDefaultTeamUserParams{
+			IsDefault: true,
+			ID:        tuID,
+		})
+	})
+	return userID, err
+}
+
+// provisionTeam returns the configured team, creating it for the first user.
+// It's remembered by id, a personal team named the same is never joined.
+func (svc *OIDCService) provisionTeam(ctx context.Context, q *model.Queries, userName string) (int64, error) {
+	if svc.config.Team == "" {
+		return q.CreateTeam(ctx, userName)
+	}
+	teamID, err := q.GetOIDCTeam(ctx, svc.config.Team)
+	if err != sql.ErrNoRows {
+		return teamID, err
+	}
+	teamID, err = q.CreateTeam(ctx, svc.config.Team)
+	if err != nil {
+		return 0, err
+	}
+	return teamID, q.CreateOIDCTeam(ctx, model.CreateOIDCTeamParams{
+		Name:   svc.config.Team,
+		TeamID: teamID,
+	})
+}
@@ -0,0 +1,292 @@
+package sqlite_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sqlite"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const testClientID = "dials"
+
+type fakeGrant struct {
+	nonce     string
+	challenge string
+	subject   string
+	userName  string
+}
+
+// fakeProvider is an in-process OpenID provider that authorizes whoever the
+// test says is logging in.
+type fakeProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]fakeGrant
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{
+		t:      t,
+		key:    key,
+		grants: map[string]fakeGrant{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/keys", p.handleKeys)
+	mux.HandleFunc("/token", p.handleToken)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/authorize",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *fakeProvider) handleKeys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{
+			Key:       &p.key.PublicKey,
+			KeyID:     "test",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}},
+	})
+}
+
+func (p *fakeProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	grant, ok := p.grants[r.FormValue("code")]
+	delete(p.grants, r.FormValue("code"))
+	p.mu.Unlock()
+
+	hash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(hash[:]) != grant.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: p.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"),
+	)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":                p.server.URL,
+		"sub":                grant.subject,
+		"aud":                testClientID,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"nonce":              grant.nonce,
+		"preferred_username": grant.userName,
+	})
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	signed, err := signer.Sign(claims)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	idToken, err := signed.CompactSerialize()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+// authorize plays the user consenting at the provider and returns the state
+// and code the provider would redirect back with.
+func (p *fakeProvider) authorize(authURL, subject, userName string) (string, string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" {
+		p.t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	code := base64.RawURLEncoding.EncodeToString([]byte(subject + query.Get("state")))
+	p.mu.Lock()
+	p.grants[code] = fakeGrant{
+		nonce:     query.Get("nonce"),
+		challenge: query.Get("code_challenge"),
+		subject:   subject,
+		userName:  userName,
+	}
+	p.mu.Unlock()
+	return query.Get("state"), code
+}
+
+func TestOIDCService(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	provider := newFakeProvider(t)
+	authService := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+	svc, err := sqlite.NewOIDCService(ctx, db, sqlite.OIDCConfig{
+		Issuer:      provider.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost:8000/login/oidc/callback",
+		Team:        "acme",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	login := func(subject, userName string) sqlite.AuthOutput {
+		authURL, _, err := svc.AuthCodeURL(ctx, "/dials")
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, code := provider.authorize(authURL, subject, userName)
+		output, next, err := svc.Callback(ctx, state, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.OK && next != "/dials" {
+			t.Fatalf("expected next /dials, got %s", next)
+		}
+		return output
+	}
+
+	// signing up with the team's name gets a personal team by that name,
+	// which must not be the one provisioned
+	if _, err := authService.Signup(ctx, sqlite.AuthInput{UserName: "acme", Password: testPassword}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	output, err := authService.Login(ctx, sqlite.AuthInput{UserName: "acme", Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	squatter, err := authService.GetTeamUserFromSession(ctx, output.Token)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	// a new user is provisioned into the configured team
+	output = login("1", "Alice")
+	if !output.OK {
+		t.Fatal("expected successful login")
+	}
+	alice, err := authService.GetTeamUserFromSession(ctx, output.Token)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if alice.TeamID == squatter.TeamID {
+		t.Fatal("expected the configured team, not the personal team named like it")
+	}
+	user, err := db.Queries.GetUserById(ctx, alice.UserID)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if user.UserName != "alice" {
+		t.Fatalf("expected username alice, got %s", user.UserName)
+	}
+
+	// a second user joins the same team
+	output = login("2", "bob")
+	if !output.OK {
+		t.Fatal("expected successful login")
+	}
+	bob, err := authService.GetTeamUserFromSession(ctx, output.Token)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if bob.TeamID != alice.TeamID {
+		t.Fatalf("expected team %d, got %d", alice.TeamID, bob.TeamID)
+	}
+
+	// logging in again finds the linked user even if the claim changed
+	output = login("1", "alice.renamed")
+	if !output.OK {
+		t.Fatal("expected successful login")
+	}
+	identity, err := authService.GetTeamUserFromSession(ctx, output.Token)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if identity.ID != alice.ID {
+		t.Fatalf("expected team user %d, got %d", alice.ID, identity.ID)
+	}
+
+	// a local account is never taken over by a matching username
+	_, err = authService.Signup(ctx, sqlite.AuthInput{
+		UserName: "carol",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if login("3", "carol").OK {
+		t.Fatal("expected failed login")
+	}
+
+	// a state can only be used once
+	authURL, _, err := svc.AuthCodeURL(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	state, code := provider.authorize(authURL, "4", "dave")
+	output, _, err = svc.Callback(ctx, state, code)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if !output.OK {
+		t.Fatal("expected successful login")
+	}
+	output, _, err = svc.Callback(ctx, state, code)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if output.OK {
+		t.Fatal("expected failed login")
+	}
+}
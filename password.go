@@ -0,0 +1,69 @@
+package sqlite
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+//go:embed common-passwords.txt
+var commonPasswordsFile string
+
+var commonPasswords = func() map[string]bool {
+	passwords := map[string]bool{}
+	for _, line := range strings.Split(commonPasswordsFile, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+	return passwords
+}()
+
+type PasswordPolicy struct {
+	// MinLength is counted in characters.
+	MinLength int
+	// MaxLength is counted in bytes, bcrypt ignores everything past 72.
+	MaxLength int
+	// BanCommon refuses passwords from the embedded common passwords list.
+	BanCommon bool
+	// BanUsername refuses passwords that contain the username or are
+	// contained in it.
+	BanUsername bool
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:   8,
+	MaxLength:   72,
+	BanCommon:   true,
+	BanUsername: true,
+}
+
+// Check returns a message for every rule the password breaks.
+func (p PasswordPolicy) Check(userName, password string) []string {
+	var problems []string
+	if p.MinLength > 0 && utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("Password must be at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("Password must be at most %d bytes", p.MaxLength))
+	}
+	lower := strings.ToLower(password)
+	if p.BanCommon && commonPasswords[lower] {
+		problems = append(problems, "Password is too common")
+	}
+	userName = strings.ToLower(userName)
+	if p.BanUsername && userName != "" && lower != "" &&
+		(strings.Contains(lower, userName) || strings.Contains(userName, lower) || lower == reverse(userName)) {
+		problems = append(problems, "Password is too similar to the username")
+	}
+	return problems
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
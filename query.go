@@ -0,0 +1,150 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"log/slog"
+	"sqlite/model"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// instrumentedDB times the queries of model.Queries by the name sqlc gives
+// them, counts their errors and logs the slow ones.
+type instrumentedDB struct {
+	model.DBTX
+	db *DB
+}
+
+func (db *DB) instrument(dbtx model.DBTX) model.DBTX {
+	return instrumentedDB{DBTX: dbtx, db: db}
+}
+
+func (i instrumentedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := i.DBTX.ExecContext(ctx, query, args...)
+	i.observe(ctx, query, args, start, err)
+	return result, err
+}
+
+// QueryContext only times the query up to the first row, reading the rest is
+// up to the caller.
+func (i instrumentedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := i.DBTX.QueryContext(ctx, query, args...)
+	i.observe(ctx, query, args, start, err)
+	return rows, err
+}
+
+// QueryRowContext only counts the errors of starting the query, the errors
+// of stepping to the row, like a constraint failing in an insert returning
+// it, only come with Scan and are counted by countedRows.
+func (i instrumentedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := i.DBTX.QueryRowContext(ctx, query, args...)
+	i.observe(ctx, query, args, start, row.Err())
+	return row
+}
+
+func (i instrumentedDB) observe(ctx context.Context, query string, args []interface{}, start time.Time, err error) {
+	elapsed := time.Since(start)
+	name := queryName(query)
+	queryDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+	if err != nil {
+		queryErrors.WithLabelValues(name).Inc()
+	}
+	if i.db.slowQuery > 0 && elapsed >= i.db.slowQuery {
+		ctx := context.WithoutCancel(ctx)
+		select {
+		case i.db.explains <- struct{}{}:
+			// in the background, the connection the plan needs may be the
+			// one the caller is still using
+			go func() {
+				plan, err := i.db.queryPlan(ctx, query, args)
+				<-i.db.explains
+				logSlowQuery(ctx, name, elapsed, plan, err)
+			}()
+		default:
+			// when everything is slow, explaining every query only adds to it
+			slog.WarnContext(ctx, "slow query", "query", name, "duration", elapsed)
+		}
+	}
+}
+
+// countedConn is a connection of the driver's that counts the errors queries
+// run into stepping through their rows.
+type countedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c countedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	sqliteRows, ok := rows.(*sqlite3.SQLiteRows)
+	name := queryName(query)
+	// only the queries of model.Queries are measured
+	if !ok || name == "unnamed" {
+		return rows, nil
+	}
+	return countedRows{SQLiteRows: sqliteRows, name: name}, nil
+}
+
+type countedRows struct {
+	*sqlite3.SQLiteRows
+	name string
+}
+
+func (r countedRows) Next(dest []driver.Value) error {
+	err := r.SQLiteRows.Next(dest)
+	if err != nil && err != io.EOF {
+		queryErrors.WithLabelValues(r.name).Inc()
+	}
+	return err
+}
+
+// queryName returns the name in the "-- name: GetDial :one" comment sqlc
+// starts its queries with.
+func queryName(query string) string {
+	line, _, _ := strings.Cut(query, "\n")
+	name, ok := strings.CutPrefix(line, "-- name: ")
+	if !ok {
+		return "unnamed"
+	}
+	name, _, _ = strings.Cut(name, " ")
+	return name
+}
+
+// logSlowQuery logs a slow query with its plan, without its arguments, which
+// may be secrets, under the request that ran it.
+func logSlowQuery(ctx context.Context, name string, elapsed time.Duration, plan string, err error) {
+	if err != nil {
+		slog.WarnContext(ctx, "slow query", "query", name, "duration", elapsed, "plan_err", err)
+		return
+	}
+	slog.WarnContext(ctx, "slow query", "query", name, "duration", elapsed, "plan", plan)
+}
+
+// queryPlan explains query on the read connections, a step per line.
+func (db *DB) queryPlan(ctx context.Context, query string, args []interface{}) (string, error) {
+	rows, err := db.read.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var steps []string
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			return "", err
+		}
+		steps = append(steps, detail)
+	}
+	return strings.Join(steps, "; "), rows.Err()
+}
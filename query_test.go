@@ -0,0 +1,145 @@
+package sqlite_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sqlite"
+	"sqlite/model"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// syncBuffer collects log output written from other goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// queryMetric returns the number of observations of the query's duration and
+// its errors so far.
+func queryMetric(t *testing.T, query string) (observed uint64, failed float64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != 1 || metric.GetLabel()[0].GetValue() != query {
+				continue
+			}
+			switch family.GetName() {
+			case "db_query_duration_seconds":
+				observed = metric.GetHistogram().GetSampleCount()
+			case "db_query_errors_total":
+				failed = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return observed, failed
+}
+
+func TestQueryInstrumentation(t *testing.T) {
+	ctx := sqlite.ContextWithRequestID(context.Background(), "req-1")
+	db, err := sqlite.OpenDb(ctx, filepath.Join(t.TempDir(), "app.db"), sqlite.DBConfig{SlowQuery: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	if err := db.Migrate(ctx, sqlite.MigrateConfig{SkipBackup: true}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	var logs syncBuffer
+	previous := slog.Default()
+	slog.SetDefault(sqlite.NewLogger(&logs, sqlite.LogConfig{}))
+	defer func() {
+		// setting a logger as the default redirects the log package to it
+		slog.SetDefault(previous)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	createdBefore, duplicatesBefore := queryMetric(t, "CreateUser")
+	foundBefore, failedBefore := queryMetric(t, "GetUserByUsername")
+	if _, err := db.Queries.CreateUser(ctx, model.CreateUserParams{UserName: "foo", Password: []byte("foo")}); err != nil {
+		t.Fatal(err)
+		return
+	}
+	// queries within transactions are measured too
+	err = db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		_, err := q.CreateUser(ctx, model.CreateUserParams{UserName: "foo", Password: []byte("foo")})
+		return err
+	})
+	if err == nil {
+		t.Fatal("expected the username to be taken")
+	}
+	// only a couple of slow queries are explained at once, wait for the
+	// plans of the inserts so the next one is
+	for deadline := time.Now().Add(time.Second); strings.Count(logs.String(), "plan=") < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := db.ReadQueries.GetUserByUsername(ctx, "foo"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	// no rows isn't an error of the query's
+	if _, err := db.ReadQueries.GetUserByUsername(ctx, "bar"); err != sql.ErrNoRows {
+		t.Fatalf("expected no rows, got %v", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := db.ReadQueries.GetUserByUsername(cancelled, "foo"); err == nil {
+		t.Fatal("expected the query to fail")
+	}
+	created, duplicates := queryMetric(t, "CreateUser")
+	found, failed := queryMetric(t, "GetUserByUsername")
+	if created-createdBefore != 2 || found-foundBefore != 3 || failed-failedBefore != 1 {
+		t.Fatalf("expected 2 CreateUser and 3 GetUserByUsername with 1 failed, got %d and %d with %v failed",
+			created-createdBefore, found-foundBefore, failed-failedBefore)
+	}
+	// the insert of a taken username only fails when its row is scanned
+	if duplicates-duplicatesBefore != 1 {
+		t.Fatalf("expected the duplicate CreateUser to be counted, got %v", duplicates-duplicatesBefore)
+	}
+
+	// slow queries are logged with their plan in the background, under the
+	// request that ran them
+	planned := func() string {
+		for _, l := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(l, "query=GetUserByUsername") && strings.Contains(l, "plan=") {
+				return l
+			}
+		}
+		return ""
+	}
+	deadline := time.Now().Add(time.Second)
+	for planned() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	line := planned()
+	if !strings.Contains(line, "SEARCH user USING") || !strings.Contains(line, "request_id=req-1") {
+		t.Fatalf("expected the slow query to be logged with its plan, got %q", logs.String())
+	}
+}
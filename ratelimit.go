@@ -0,0 +1,136 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"sqlite/model"
+	"time"
+)
+
+type RateLimitConfig struct {
+	// FreeAttempts is how many failures a key gets before it is locked out.
+	FreeAttempts int
+	// BaseDelay is the first lockout, every further failure doubles it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// ResetAfter forgets the failures of a key that has been quiet this long.
+	ResetAfter time.Duration
+}
+
+var DefaultRateLimitConfig = RateLimitConfig{
+	FreeAttempts: 5,
+	BaseDelay:    time.Second,
+	MaxDelay:     15 * time.Minute,
+	ResetAfter:   24 * time.Hour,
+}
+
+// RateLimiter tracks failures per key in the database and locks keys out with
+// an exponential backoff. Keys are namespaced strings like "ip:127.0.0.1".
+type RateLimiter struct {
+	db     *DB
+	config RateLimitConfig
+	now    func() time.Time
+}
+
+func NewRateLimiter(db *DB, config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		db:     db,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// Attempt counts an attempt against every key before it's made, unless one of
+// them is locked out, and returns how long until they may try again, zero if
+// the attempt may go ahead. Checking and counting happen in one transaction,
+// so parallel attempts can't all get through before the first of them fails.
+// Attempts that succeed are given back with Reset or Forgive.
+func (l *RateLimiter) Attempt(ctx context.Context, keys ...string) (time.Duration, error) {
+	now := l.now()
+	var wait time.Duration
+	err := l.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		wait = 0
+		for _, key := range keys {
+			attempt, err := q.GetLoginAttempt(ctx, key)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if d := time.Unix(attempt.LockedUntil, 0).Sub(now); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			return nil
+		}
+		for _, key := range keys {
+			failures, err := q.RecordLoginFailure(ctx, model.RecordLoginFailureParams{
+				Key:         key,
+				Now:         now.Unix(),
+				ResetBefore: now.Add(-l.config.ResetAfter).Unix(),
+			})
+			if err != nil {
+				return err
+			}
+			if delay := l.delay(failures); delay > 0 {
+				err = q.LockLoginAttempt(ctx, model.LockLoginAttemptParams{
+					LockedUntil: now.Add(delay).Unix(),
+					Key:         key,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return wait, err
+}
+
+// Forgive takes back the attempt counted against the keys by an Attempt that
+// succeeded, leaving the other failures as they are.
+func (l *RateLimiter) Forgive(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := l.db.queries(ctx).ForgiveLoginFailure(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset forgets the failures of the keys.
+func (l *RateLimiter) Reset(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := l.db.queries(ctx).DeleteLoginAttempt(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge deletes the keys that have been quiet long enough for their failures
+// to be forgotten and aren't locked out, and returns how many it deleted.
+func (l *RateLimiter) Purge(ctx context.Context) (int64, error) {
+	now := l.now()
+	return l.db.queries(ctx).DeleteStaleLoginAttempts(ctx, model.DeleteStaleLoginAttemptsParams{
+		ResetBefore: now.Add(-l.config.ResetAfter).Unix(),
+		Now:         now.Unix(),
+	})
+}
+
+func (l *RateLimiter) delay(failures int64) time.Duration {
+	over := failures - int64(l.config.FreeAttempts)
+	if over < 0 {
+		return 0
+	}
+	delay := l.config.BaseDelay
+	for i := int64(0); i < over && delay < l.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.config.MaxDelay {
+		delay = l.config.MaxDelay
+	}
+	return delay
+}
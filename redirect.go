@@ -0,0 +1,35 @@
+package sqlite
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// SafeRedirect returns next if it is a relative path on this site, and "/"
+// otherwise. Anything a browser could resolve to another origin is refused:
+// absolute and protocol relative urls, backslashes (which browsers treat like
+// slashes) and control or space characters (which browsers strip, so "/\t/x"
+// becomes "//x").
+func SafeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return "/"
+	}
+	for _, r := range next {
+		if unicode.IsControl(r) || unicode.IsSpace(r) {
+			return "/"
+		}
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	return next
+}
+
+// loginURL sends the user to the login page and back to the current page,
+// query string included, once they are in.
+func loginURL(r *http.Request) string {
+	return "/login?next=" + url.QueryEscape(r.URL.RequestURI())
+}
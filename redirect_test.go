@@ -0,0 +1,59 @@
+package sqlite_test
+
+import (
+	"net/http"
+	"sqlite"
+	"testing"
+)
+
+func TestSafeRedirect(t *testing.T) {
+	tests := map[string]string{
+		"":                            "/",
+		"/":                           "/",
+		"/dials":                      "/dials",
+		"/dials/1?tab=edit&x=%2F":     "/dials/1?tab=edit&x=%2F",
+		"/dials#value":                "/dials#value",
+		"dials":                       "/",
+		"//evil.example":              "/",
+		"///evil.example":             "/",
+		"/\\evil.example":             "/",
+		"\\\\evil.example":            "/",
+		"https://evil.example":        "/",
+		"HTTPS://evil.example/dials":  "/",
+		"javascript:alert(1)":         "/",
+		"/\t/evil.example":            "/",
+		"/\n/evil.example":            "/",
+		" //evil.example":             "/",
+		"/%2F%2Fevil.example":         "/%2F%2Fevil.example",
+		"/ /evil.example":             "/",
+		"data:text/html,<script>":     "/",
+		"/dials?next=//evil.example":  "/dials?next=//evil.example",
+		"/%zz":                        "/",
+		"http:/evil.example":          "/",
+		"/login?next=http://evil.com": "/login?next=http://evil.com",
+	}
+	for next, expected := range tests {
+		if got := sqlite.SafeRedirect(next); got != expected {
+			t.Errorf("SafeRedirect(%q): expected %q, got %q", next, expected, got)
+		}
+	}
+}
+
+func TestRequireAuthRedirect(t *testing.T) {
+	server := newTestServer(t)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(server.URL + "/dials/1/edit?tab=a&b=c%20d")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	res.Body.Close()
+	expected := "/login?next=%2Fdials%2F1%2Fedit%3Ftab%3Da%26b%3Dc%2520d"
+	if location := res.Header.Get("Location"); location != expected {
+		t.Fatalf("expected redirect to %s, got %s", expected, location)
+	}
+}
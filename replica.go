@@ -0,0 +1,344 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrReplicaNotFound is returned by ReplicaTarget.Get for keys that don't
+// exist.
+var ErrReplicaNotFound = errors.New("replica file not found")
+
+// ReplicaTarget stores the files of a replica by key, like an object store.
+// Keys are slash separated paths such as "generations/<id>/snapshot.db.gz".
+type ReplicaTarget interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns ErrReplicaNotFound if there is no file with the key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys starting with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// DirTarget replicates to a local directory, such as a mounted volume.
+type DirTarget struct {
+	Dir string
+}
+
+func (t DirTarget) path(key string) string {
+	return filepath.Join(t.Dir, filepath.FromSlash(key))
+}
+
+// Put writes the file under a temporary name first, so a file that is
+// listed is always complete.
+func (t DirTarget) Put(ctx context.Context, key string, r io.Reader) error {
+	path := t.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (t DirTarget) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(t.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrReplicaNotFound
+	}
+	return f, err
+}
+
+func (t DirTarget) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(t.Dir, func(path string, entry os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".put-") {
+			return nil
+		}
+		rel, err := filepath.Rel(t.Dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (t DirTarget) Delete(ctx context.Context, key string) error {
+	err := os.Remove(t.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// S3Target replicates to a bucket of an S3 compatible object store, using
+// path style URLs so it works with stores other than AWS too.
+type S3Target struct {
+	// Endpoint is the URL of the store, like https://s3.eu-west-1.amazonaws.com
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every key, to share a bucket.
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Put streams the payload without signing it, so snapshots as large as the
+// database aren't read twice. The store needs the length up front, readers
+// that aren't files are spooled to a temporary one first.
+func (t S3Target) Put(ctx context.Context, key string, r io.Reader) error {
+	f, ok := r.(*os.File)
+	if !ok {
+		tmp, err := os.CreateTemp("", "s3-put-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		f = tmp
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	size := info.Size() - offset
+	// the limit also keeps the client from closing the caller's file
+	resp, err := t.do(ctx, http.MethodPut, t.Prefix+key, nil, io.LimitReader(f, size), size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t S3Target) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, http.MethodGet, t.Prefix+key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (t S3Target) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {t.Prefix + prefix}}
+	for {
+		resp, err := t.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode bucket listing: %w", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, t.Prefix))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (t S3Target) Delete(ctx context.Context, key string) error {
+	resp, err := t.do(ctx, http.MethodDelete, t.Prefix+key, nil, nil, 0)
+	if err == ErrReplicaNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a request signed with AWS signature version 4, a body of size
+// bytes is sent unsigned. Responses other than 2xx are turned into errors, a
+// missing key into ErrReplicaNotFound.
+func (t S3Target) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	endpoint, err := url.Parse(t.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	path := "/" + s3Escape(t.Bucket, false)
+	if key != "" {
+		path += "/" + s3Escape(key, true)
+	}
+	// url.Values sorts by key, which is what signing needs too
+	rawQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+	target := endpoint.Scheme + "://" + endpoint.Host + path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256Hex(nil)
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		rawQuery,
+		"host:" + endpoint.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + t.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	signingKey := []byte("AWS4" + t.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), t.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(signingKey, stringToSign))))
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && key != "" {
+			return nil, ErrReplicaNotFound
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes when keepSlash is set, as signing requires.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// ParseReplicaTarget turns where a replica is into a target. It's a local
+// directory, or s3://bucket/prefix for an S3 compatible store with the
+// credentials, region and endpoint in the usual AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_REGION and AWS_ENDPOINT_URL variables.
+func ParseReplicaTarget(location string) (ReplicaTarget, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return DirTarget{Dir: location}, nil
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket in %s", location)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return S3Target{
+		Endpoint:        endpoint,
+		Region:          region,
+		Bucket:          bucket,
+		Prefix:          prefix,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}, nil
+}
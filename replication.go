@@ -0,0 +1,694 @@
+package sqlite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A replica is a series of generations. Each starts with a snapshot of the
+// database and continues with segments of WAL frames in the order they were
+// committed:
+//
+//	generations/<time>/snapshot.db.gz
+//	generations/<time>/wal/<index>-<time>.wal.gz
+//
+// Times are UTC and sort the way they happened, a segment holds whole
+// transactions committed by the time in its name.
+const replicaTimeFormat = "20060102T150405.000000000Z"
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+)
+
+var errInvalidWAL = errors.New("invalid WAL header")
+
+type walHeader struct {
+	raw []byte
+	// bigEndian is how checksums read the data, everything else in the WAL
+	// is big-endian anyway
+	bigEndian bool
+	pageSize  int
+	salt      [2]uint32
+	checksum  [2]uint32
+}
+
+func parseWALHeader(b []byte) (walHeader, error) {
+	if len(b) < walHeaderSize {
+		return walHeader{}, errInvalidWAL
+	}
+	h := walHeader{raw: append([]byte(nil), b[:walHeaderSize]...)}
+	switch binary.BigEndian.Uint32(b[0:4]) {
+	case 0x377f0682:
+	case 0x377f0683:
+		h.bigEndian = true
+	default:
+		return h, errInvalidWAL
+	}
+	h.pageSize = int(binary.BigEndian.Uint32(b[8:12]))
+	if h.pageSize == 1 {
+		h.pageSize = 65536
+	}
+	h.salt = [2]uint32{binary.BigEndian.Uint32(b[16:20]), binary.BigEndian.Uint32(b[20:24])}
+	h.checksum = [2]uint32{binary.BigEndian.Uint32(b[24:28]), binary.BigEndian.Uint32(b[28:32])}
+	if walChecksum(h.bigEndian, b[:24], [2]uint32{}) != h.checksum {
+		return h, errInvalidWAL
+	}
+	return h, nil
+}
+
+// walChecksum continues the running checksum SQLite keeps over a WAL.
+func walChecksum(bigEndian bool, b []byte, sum [2]uint32) [2]uint32 {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	for i := 0; i+8 <= len(b); i += 8 {
+		sum[0] += order.Uint32(b[i:]) + sum[1]
+		sum[1] += order.Uint32(b[i+4:]) + sum[0]
+	}
+	return sum
+}
+
+// walPosition is how far into a WAL the replica has got.
+type walPosition struct {
+	salt     [2]uint32
+	offset   int64
+	checksum [2]uint32
+}
+
+// readWAL reads the frames after pos up to the last commit that is fully
+// written, checking their salts and checksums like SQLite does when it
+// recovers a WAL. The frames are written to frames if it isn't nil.
+func readWAL(path string, hdr walHeader, pos walPosition, frames *bytes.Buffer) (walPosition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return pos, err
+	}
+	defer f.Close()
+	buf := make([]byte, walFrameHeaderSize+hdr.pageSize)
+	committed, cur := pos, pos
+	committedLen := 0
+	if frames != nil {
+		committedLen = frames.Len()
+	}
+	for {
+		if _, err := f.ReadAt(buf, cur.offset); err == io.EOF {
+			break
+		} else if err != nil {
+			return pos, err
+		}
+		if binary.BigEndian.Uint32(buf[8:12]) != hdr.salt[0] || binary.BigEndian.Uint32(buf[12:16]) != hdr.salt[1] {
+			break
+		}
+		sum := walChecksum(hdr.bigEndian, buf[:8], cur.checksum)
+		sum = walChecksum(hdr.bigEndian, buf[walFrameHeaderSize:], sum)
+		if sum != [2]uint32{binary.BigEndian.Uint32(buf[16:20]), binary.BigEndian.Uint32(buf[20:24])} {
+			break
+		}
+		if frames != nil {
+			frames.Write(buf)
+		}
+		cur.offset += int64(len(buf))
+		cur.checksum = sum
+		// frames of a transaction end with one that records the database
+		// size, the commit
+		if binary.BigEndian.Uint32(buf[4:8]) != 0 {
+			committed = cur
+			if frames != nil {
+				committedLen = frames.Len()
+			}
+		}
+	}
+	if frames != nil {
+		frames.Truncate(committedLen)
+	}
+	return committed, nil
+}
+
+type ReplicationConfig struct {
+	Target ReplicaTarget
+	// Interval is how often new WAL frames are shipped, a second by default.
+	// It's how much can be lost.
+	Interval time.Duration
+	// SnapshotInterval is how often a new generation starts, a day by
+	// default. Restores replay the WAL since the snapshot, this bounds how
+	// much.
+	SnapshotInterval time.Duration
+	// CheckpointPages is how large the WAL may grow before the replicator
+	// checkpoints it, 1000 pages like SQLite by default.
+	CheckpointPages int
+	// KeepGenerations is how many generations are kept, 3 by default. Point
+	// in time restores reach back to the oldest snapshot.
+	KeepGenerations int
+}
+
+// Replicator ships the WAL of the database to a replica as it's written.
+//
+// It holds a read transaction open at all times, which stops SQLite from
+// starting the WAL over with frames the replicator hasn't shipped. Only the
+// replicator's own checkpoints let it start over, while it holds the write
+// lock and has shipped everything. If the WAL starts over any other way,
+// frames may have been missed and a new generation is started.
+type Replicator struct {
+	db     *DB
+	config ReplicationConfig
+	// path is the database file, the WAL is next to it
+	path string
+
+	mu sync.Mutex
+	// conns are the replicator's own, locking writes out and checkpointing
+	// can't wait for the write connection while writers wait for them
+	conns *sql.DB
+	// read holds the read transaction, on one of conns
+	read       *sql.Conn
+	generation string
+	started    time.Time
+	pos        walPosition
+	index      int
+	// restartExpected is set after a checkpoint of the replicator, the next
+	// writer may start the WAL over
+	restartExpected bool
+}
+
+func NewReplicator(db *DB, config ReplicationConfig) *Replicator {
+	if config.Interval == 0 {
+		config.Interval = time.Second
+	}
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = 24 * time.Hour
+	}
+	if config.CheckpointPages == 0 {
+		config.CheckpointPages = 1000
+	}
+	if config.KeepGenerations == 0 {
+		config.KeepGenerations = 3
+	}
+	return &Replicator{
+		db:     db,
+		config: config,
+	}
+}
+
+// Run ships the WAL every interval until ctx is done, then ships what's left
+// and lets go of the database. Failures are logged and counted and retried
+// at the next interval.
+func (r *Replicator) Run(ctx context.Context) {
+	if err := r.Sync(ctx); err != nil {
+		slog.ErrorContext(ctx, "replication failed", "err", err)
+	}
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.Sync(context.Background()); err != nil {
+				slog.Error("replication failed", "err", err)
+			}
+			r.Close()
+			return
+		case <-ticker.C:
+			if err := r.Sync(ctx); err != nil {
+				slog.ErrorContext(ctx, "replication failed", "err", err)
+			}
+		}
+	}
+}
+
+// Sync ships the WAL frames committed since the last sync, starting a new
+// generation first when one is due.
+func (r *Replicator) Sync(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.syncLocked(ctx)
+	if err != nil {
+		replicationSyncs.WithLabelValues("failed").Inc()
+		return err
+	}
+	replicationSyncs.WithLabelValues("ok").Inc()
+	replicationLastSync.SetToCurrentTime()
+	return nil
+}
+
+func (r *Replicator) syncLocked(ctx context.Context) error {
+	if r.path == "" {
+		path, err := r.db.file(ctx)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			return errors.New("in-memory databases can't be replicated")
+		}
+		r.path = path
+	}
+	if r.conns == nil {
+		connector, err := NewConnector(r.path, DBConfig{})
+		if err != nil {
+			return err
+		}
+		r.conns = sql.OpenDB(connector)
+	}
+	if r.generation == "" || time.Since(r.started) > r.config.SnapshotInterval {
+		return r.startGeneration(ctx)
+	}
+	restarted, err := r.ship(ctx)
+	if err != nil {
+		return err
+	}
+	if restarted {
+		slog.WarnContext(ctx, "replication: the WAL was started over by someone else, starting a new generation", "generation", r.generation)
+		return r.startGeneration(ctx)
+	}
+	hdr, ok, err := r.walHeader()
+	if err != nil || !ok {
+		return err
+	}
+	// after a checkpoint the WAL stays as large until someone writes
+	if !r.restartExpected && r.pos.offset > walHeaderSize+int64(r.config.CheckpointPages*(walFrameHeaderSize+hdr.pageSize)) {
+		return r.checkpoint(ctx)
+	}
+	return nil
+}
+
+// Close lets go of the read transaction, the WAL can be checkpointed as
+// usual again. Sync takes it again.
+func (r *Replicator) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.releaseRead()
+	if r.conns != nil {
+		r.conns.Close()
+		r.conns = nil
+	}
+	// without the read transaction nothing stops the WAL from starting
+	// over, the next sync has to start a generation
+	r.generation = ""
+}
+
+func (r *Replicator) walHeader() (walHeader, bool, error) {
+	f, err := os.Open(r.path + "-wal")
+	if os.IsNotExist(err) {
+		return walHeader{}, false, nil
+	}
+	if err != nil {
+		return walHeader{}, false, err
+	}
+	defer f.Close()
+	buf := make([]byte, walHeaderSize)
+	if _, err := f.ReadAt(buf, 0); err == io.EOF {
+		return walHeader{}, false, nil
+	} else if err != nil {
+		return walHeader{}, false, err
+	}
+	hdr, err := parseWALHeader(buf)
+	if err == errInvalidWAL {
+		// SQLite treats a WAL without a valid header as empty too
+		return hdr, false, nil
+	}
+	return hdr, err == nil, err
+}
+
+func (r *Replicator) acquireRead(ctx context.Context) error {
+	// holding one of the read pool for good would leave the server a reader
+	// short
+	conn, err := r.conns.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `begin`); err != nil {
+		conn.Close()
+		return err
+	}
+	// a transaction only starts reading with its first statement
+	var tables int
+	if err := conn.QueryRowContext(ctx, `select count(*) from sqlite_schema`).Scan(&tables); err != nil {
+		conn.ExecContext(ctx, `rollback`)
+		conn.Close()
+		return err
+	}
+	r.read = conn
+	return nil
+}
+
+func (r *Replicator) releaseRead() {
+	if r.read == nil {
+		return
+	}
+	r.read.ExecContext(context.Background(), `rollback`)
+	r.read.Close()
+	r.read = nil
+}
+
+// lockWrites takes the write lock on a connection of its own, so nothing is
+// committed until unlock is called.
+func (r *Replicator) lockWrites(ctx context.Context) (unlock func(), err error) {
+	conn, err := r.conns.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, `begin immediate`); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(context.Background(), `rollback`)
+		conn.Close()
+	}, nil
+}
+
+// startGeneration snapshots the database and ships the WAL from where the
+// snapshot leaves off.
+func (r *Replicator) startGeneration(ctx context.Context) error {
+	r.releaseRead()
+	r.generation = ""
+	// with writes locked out the snapshot and the end of the WAL agree
+	unlock, err := r.lockWrites(ctx)
+	if err != nil {
+		return err
+	}
+	var pos walPosition
+	hdr, ok, err := r.walHeader()
+	if err == nil && ok {
+		pos, err = readWAL(r.path+"-wal", hdr, walPosition{salt: hdr.salt, offset: walHeaderSize, checksum: hdr.checksum}, nil)
+	}
+	if err == nil {
+		err = r.acquireRead(ctx)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	started := time.Now().UTC()
+	generation := started.Format(replicaTimeFormat)
+	dir, err := os.MkdirTemp("", "snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.db")
+	// the read transaction is what the snapshot sees, so it's copied in one
+	// step rather than restarting when someone writes
+	if err := onlineBackup(ctx, r.read, snapshot); err != nil {
+		return fmt.Errorf("cannot snapshot db: %w", err)
+	}
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := putCompressed(ctx, r.config.Target, "generations/"+generation+"/snapshot.db.gz", f); err != nil {
+		return err
+	}
+	r.generation, r.started, r.pos, r.index, r.restartExpected = generation, started, pos, 0, false
+	slog.InfoContext(ctx, "replication: started generation", "generation", generation)
+	return r.pruneGenerations(ctx)
+}
+
+// ship sends the committed frames after the current position as a segment.
+// It reports whether the WAL started over in a way that may have lost
+// frames.
+func (r *Replicator) ship(ctx context.Context) (bool, error) {
+	hdr, ok, err := r.walHeader()
+	if err != nil || !ok {
+		return false, err
+	}
+	pos := r.pos
+	if hdr.salt != pos.salt {
+		// only a restart the replicator allowed has nothing missing
+		if !r.restartExpected && pos.offset != 0 {
+			return true, nil
+		}
+		pos = walPosition{salt: hdr.salt, offset: walHeaderSize, checksum: hdr.checksum}
+	}
+	var frames bytes.Buffer
+	frames.Write(hdr.raw)
+	next, err := readWAL(r.path+"-wal", hdr, pos, &frames)
+	if err != nil {
+		return false, err
+	}
+	if next == pos {
+		return false, nil
+	}
+	key := fmt.Sprintf("generations/%s/wal/%08d-%s.wal.gz", r.generation, r.index, time.Now().UTC().Format(replicaTimeFormat))
+	if err := putCompressed(ctx, r.config.Target, key, &frames); err != nil {
+		return false, err
+	}
+	r.pos, r.restartExpected = next, false
+	r.index++
+	return false, nil
+}
+
+// checkpoint copies the WAL into the database so it can start over. Writes
+// are locked out from shipping the last frames until the checkpoint is done,
+// so none are lost when it does.
+func (r *Replicator) checkpoint(ctx context.Context) error {
+	unlock, err := r.lockWrites(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	restarted, err := r.ship(ctx)
+	if err != nil {
+		return err
+	}
+	if restarted {
+		// the next sync notices again and starts a generation
+		return nil
+	}
+	r.releaseRead()
+	result, err := r.db.checkpoint(ctx, r.conns, "passive")
+	if readErr := r.acquireRead(ctx); err == nil {
+		err = readErr
+	}
+	if err != nil {
+		r.generation = ""
+		return err
+	}
+	r.restartExpected = result.Frames == result.Checkpointed
+	return nil
+}
+
+func (r *Replicator) pruneGenerations(ctx context.Context) error {
+	generations, err := listGenerations(ctx, r.config.Target)
+	if err != nil {
+		return err
+	}
+	for len(generations) > r.config.KeepGenerations {
+		for _, key := range generations[0].keys {
+			if err := r.config.Target.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+		generations = generations[1:]
+	}
+	return nil
+}
+
+// putCompressed compresses to a temporary file rather than memory, snapshots
+// are as large as the database.
+func putCompressed(ctx context.Context, target ReplicaTarget, key string, r io.Reader) error {
+	tmp, err := os.CreateTemp("", "replica-*.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	gz := gzip.NewWriter(tmp)
+	if _, err := io.Copy(gz, r); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := target.Put(ctx, key, tmp); err != nil {
+		return fmt.Errorf("cannot replicate %s: %w", key, err)
+	}
+	return nil
+}
+
+func getCompressed(ctx context.Context, target ReplicaTarget, key string) (io.ReadCloser, error) {
+	rc, err := target.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("cannot decompress %s: %w", key, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, rc}, nil
+}
+
+type replicaGeneration struct {
+	name     string
+	started  time.Time
+	snapshot string
+	// segments are in the order they were shipped
+	segments []string
+	keys     []string
+}
+
+// listGenerations returns the generations in a replica, oldest first.
+func listGenerations(ctx context.Context, target ReplicaTarget) ([]replicaGeneration, error) {
+	keys, err := target.List(ctx, "generations/")
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*replicaGeneration{}
+	var generations []*replicaGeneration
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, "generations/"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		g, ok := byName[parts[0]]
+		if !ok {
+			started, err := time.Parse(replicaTimeFormat, parts[0])
+			if err != nil {
+				continue
+			}
+			g = &replicaGeneration{name: parts[0], started: started}
+			byName[parts[0]] = g
+			generations = append(generations, g)
+		}
+		g.keys = append(g.keys, key)
+		if parts[1] == "snapshot.db.gz" {
+			g.snapshot = key
+		} else if strings.HasPrefix(parts[1], "wal/") {
+			g.segments = append(g.segments, key)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i].name < generations[j].name })
+	list := make([]replicaGeneration, len(generations))
+	for i, g := range generations {
+		list[i] = *g
+	}
+	return list, nil
+}
+
+// segmentTime is when a segment was shipped, from its key.
+func segmentTime(key string) (time.Time, error) {
+	name := strings.TrimSuffix(key[strings.LastIndex(key, "/")+1:], ".wal.gz")
+	_, stamp, _ := strings.Cut(name, "-")
+	return time.Parse(replicaTimeFormat, stamp)
+}
+
+// RestoreReplica replaces the database file at path with the database from
+// a replica, as it was at the given time, or as recent as the replica has it
+// if at is zero. Nothing may have the database open while it's restored.
+func RestoreReplica(ctx context.Context, target ReplicaTarget, path string, at time.Time) error {
+	generations, err := listGenerations(ctx, target)
+	if err != nil {
+		return err
+	}
+	// the newest generation that has a snapshot from before the time
+	var generation *replicaGeneration
+	for i := range generations {
+		g := &generations[i]
+		if g.snapshot != "" && (at.IsZero() || !g.started.After(at)) {
+			generation = g
+		}
+	}
+	if generation == nil {
+		return errors.New("the replica has no snapshot from before that time")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	snapshot, err := getCompressed(ctx, target, generation.snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, snapshot)
+	snapshot.Close()
+	if err != nil {
+		return err
+	}
+	for _, key := range generation.segments {
+		shipped, err := segmentTime(key)
+		if err != nil {
+			return fmt.Errorf("invalid segment %s: %w", key, err)
+		}
+		if !at.IsZero() && shipped.After(at) {
+			break
+		}
+		if err := applySegment(ctx, target, key, tmp); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := checkIntegrity(ctx, tmp.Name()); err != nil {
+		return err
+	}
+	// the log belongs to the database being replaced
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// applySegment writes the pages of a segment into the database file, which
+// is what a checkpoint would do with them.
+func applySegment(ctx context.Context, target ReplicaTarget, key string, db *os.File) error {
+	rc, err := getCompressed(ctx, target, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	segment, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	hdr, err := parseWALHeader(segment)
+	if err != nil {
+		return fmt.Errorf("invalid segment %s: %w", key, err)
+	}
+	frameSize := walFrameHeaderSize + hdr.pageSize
+	frames := segment[walHeaderSize:]
+	if len(frames)%frameSize != 0 {
+		return fmt.Errorf("invalid segment %s: partial frame", key)
+	}
+	for ; len(frames) > 0; frames = frames[frameSize:] {
+		pgno := int64(binary.BigEndian.Uint32(frames[0:4]))
+		if _, err := db.WriteAt(frames[walFrameHeaderSize:frameSize], (pgno-1)*int64(hdr.pageSize)); err != nil {
+			return err
+		}
+		if size := int64(binary.BigEndian.Uint32(frames[4:8])); size != 0 {
+			if err := db.Truncate(size * int64(hdr.pageSize)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
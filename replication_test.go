@@ -0,0 +1,249 @@
+package sqlite_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"sqlite"
+	"sqlite/model"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3StandIn serves the few S3 calls S3Target makes from memory.
+type s3StandIn struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("x-amz-date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "replicas" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		type object struct{ Key string }
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []object
+		}
+		for key := range s.objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, object{key})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPut:
+		// uploads are streamed with their length but not signed
+		if r.ContentLength < 0 || r.Header.Get("x-amz-content-sha256") != "UNSIGNED-PAYLOAD" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		s.objects[key] = body
+	case r.Method == http.MethodGet:
+		body, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newS3Target(t *testing.T) sqlite.S3Target {
+	server := httptest.NewServer(&s3StandIn{objects: map[string][]byte{}})
+	t.Cleanup(server.Close)
+	return sqlite.S3Target{
+		Endpoint:        server.URL,
+		Region:          "test",
+		Bucket:          "replicas",
+		Prefix:          "dials/",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	}
+}
+
+func TestReplicaTargets(t *testing.T) {
+	ctx := context.Background()
+	for name, target := range map[string]sqlite.ReplicaTarget{
+		"dir": sqlite.DirTarget{Dir: t.TempDir()},
+		"s3":  newS3Target(t),
+	} {
+		for _, key := range []string{"a/1", "a/2", "b/1 x"} {
+			if err := target.Put(ctx, key, strings.NewReader(key)); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		keys, err := target.List(ctx, "a/")
+		if err != nil || fmt.Sprint(keys) != "[a/1 a/2]" {
+			t.Fatalf("%s: expected a/1 and a/2, got %v %v", name, keys, err)
+		}
+		rc, err := target.Get(ctx, "b/1 x")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		body, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(body) != "b/1 x" {
+			t.Fatalf("%s: expected the file back, got %q %v", name, body, err)
+		}
+		if err := target.Delete(ctx, "a/1"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := target.Get(ctx, "a/1"); err != sqlite.ErrReplicaNotFound {
+			t.Fatalf("%s: expected ErrReplicaNotFound, got %v", name, err)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	for name, target := range map[string]sqlite.ReplicaTarget{
+		"dir": sqlite.DirTarget{Dir: t.TempDir()},
+		"s3":  newS3Target(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			testReplication(t, target)
+		})
+	}
+}
+
+func testReplication(t *testing.T, target sqlite.ReplicaTarget) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := sqlite.CreateAndMigrateDb(ctx, filepath.Join(dir, "app.db"))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	createUsers := func(names ...string) {
+		for _, name := range names {
+			_, err := db.Queries.CreateUser(ctx, model.CreateUserParams{
+				UserName:         name,
+				UserNameSkeleton: name,
+				Password:         bytes.Repeat([]byte("x"), 2000),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	replicator := sqlite.NewReplicator(db, sqlite.ReplicationConfig{
+		Target:          target,
+		CheckpointPages: 4,
+	})
+	defer replicator.Close()
+	sync := func() time.Time {
+		if err := replicator.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return time.Now()
+	}
+	userNames := func(at time.Time) string {
+		path := filepath.Join(t.TempDir(), "restored.db")
+		if err := sqlite.RestoreReplica(ctx, target, path, at); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+		rows, err := restored.QueryContext(ctx, `select user_name from user`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	createUsers("alice")
+	sync()
+	createUsers("bob")
+	afterBob := sync()
+	time.Sleep(10 * time.Millisecond)
+	// enough to checkpoint, the writes after it start the WAL over
+	createUsers("carol", "dave", "erin", "frank")
+	sync()
+	createUsers("grace")
+	sync()
+	createUsers("heidi")
+	sync()
+
+	if names := userNames(time.Time{}); names != "alice bob carol dave erin frank grace heidi" {
+		t.Fatalf("expected every user in the replica, got %q", names)
+	}
+	if names := userNames(afterBob); names != "alice bob" {
+		t.Fatalf("expected the replica as it was after bob, got %q", names)
+	}
+	keys, err := target.List(ctx, "generations/")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	snapshots := 0
+	for _, key := range keys {
+		if strings.HasSuffix(key, "snapshot.db.gz") {
+			snapshots++
+		}
+	}
+	if snapshots != 1 {
+		t.Fatalf("expected the checkpoint to not need a new generation, got %v", keys)
+	}
+
+	// without the replicator's read transaction anything can happen to the
+	// WAL, so it starts over with a new generation, and keeps only 3
+	for i := 0; i < 3; i++ {
+		replicator.Close()
+		createUsers(fmt.Sprintf("user%d", i))
+		sync()
+	}
+	keys, err = target.List(ctx, "generations/")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	generations := map[string]bool{}
+	for _, key := range keys {
+		generations[strings.Split(key, "/")[1]] = true
+	}
+	if len(generations) != 3 {
+		t.Fatalf("expected 3 generations, got %v", keys)
+	}
+	if names := userNames(time.Time{}); !strings.HasSuffix(names, "user0 user1 user2") {
+		t.Fatalf("expected the users of the newest generation, got %q", names)
+	}
+	if err := sqlite.RestoreReplica(ctx, target, filepath.Join(dir, "restored.db"), afterBob); err == nil {
+		t.Fatal("expected the generation from before bob to be pruned")
+	}
+}
@@ -1,11 +1,18 @@
 package sqlite
 
 import (
+	"bytes"
 	"database/sql"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"path/filepath"
 	"sqlite/templates"
 	"strconv"
 	"time"
@@ -17,19 +24,31 @@ import (
 var assetsFS embed.FS
 
 type Handler struct {
-	AuthService *AuthService
-	UserService *UserService
-	DialService *DialService
-	UseTLS      bool
+	AuthService     *AuthService
+	UserService     *UserService
+	DialService     *DialService
+	WebAuthnService *WebAuthnService
+	// OIDCService is nil when single sign-on isn't configured
+	OIDCService  *OIDCService
+	EmailService *EmailService
+	AdminService *AdminService
+	// BackupService lists no backups for in-memory databases
+	BackupService *BackupService
+	UseTLS        bool
 }
 
-func NewHandler(authService *AuthService, userService *UserService, dialService *DialService, useTLS bool) http.Handler {
+func NewHandler(authService *AuthService, userService *UserService, dialService *DialService, webAuthnService *WebAuthnService, oidcService *OIDCService, emailService *EmailService, adminService *AdminService, backupService *BackupService, useTLS bool) http.Handler {
 	mux := http.NewServeMux()
 	h := &Handler{
-		AuthService: authService,
-		UserService: userService,
-		DialService: dialService,
-		UseTLS:      useTLS,
+		AuthService:     authService,
+		UserService:     userService,
+		DialService:     dialService,
+		WebAuthnService: webAuthnService,
+		OIDCService:     oidcService,
+		EmailService:    emailService,
+		AdminService:    adminService,
+		BackupService:   backupService,
+		UseTLS:          useTLS,
 	}
 
 	router := NewInstrumentedRouter()
@@ -40,9 +59,18 @@ func NewHandler(authService *AuthService, userService *UserService, dialService
 	router.POST("/login", requireNoAuth(h.handlePostLogin))
 	router.GET("/signup", requireNoAuth(h.handleGetSignup))
 	router.POST("/signup", requireNoAuth(h.handlePostSignup))
+	router.POST("/login/passkey/begin", requireNoAuth(h.handleBeginPasskeyLogin))
+	router.POST("/login/passkey/finish", requireNoAuth(h.handleFinishPasskeyLogin))
+	if oidcService != nil {
+		router.GET("/login/oidc", requireNoAuth(h.handleGetOIDCLogin))
+		router.GET("/login/oidc/callback", requireNoAuth(h.handleOIDCCallback))
+	}
 
 	// these routes are public.
 	router.GET("/logout", h.handleLogout)
+	// the link in the email may be opened in another browser, the token is
+	// all that's needed
+	router.GET("/verify-email", h.handleVerifyEmail)
 	router.GET("/", h.handleIndex)
 
 	// these routes required an authenticated user
@@ -54,8 +82,30 @@ func NewHandler(authService *AuthService, userService *UserService, dialService
 	router.POST("/dials/:id/edit", requireAuth(h.handlePostEditDial))
 	router.PATCH("/dials/:id", requireAuth(h.handlePatchDial))
 	router.POST("/dials/:id/delete", requireAuth(h.handleDeleteDial))
+	router.GET("/account/password", requireAuth(h.handleGetPassword))
+	router.POST("/account/password", requireAuth(h.handlePostPassword))
+	router.GET("/account", requireAuth(h.handleGetAccount))
+	router.GET("/account/export", requireAuth(h.handleExportAccount))
+	router.POST("/account/delete", requireAuth(h.handleDeleteAccount))
+	router.GET("/account/email", requireAuth(h.handleGetEmail))
+	router.POST("/account/email", requireAuth(h.handlePostEmail))
+	router.POST("/account/email/resend", requireAuth(h.handleResendEmail))
+	router.GET("/passkeys", requireAuth(h.handleGetPasskeys))
+	router.POST("/passkeys/begin", requireAuth(h.handleBeginPasskeyRegistration))
+	router.POST("/passkeys/finish", requireAuth(h.handleFinishPasskeyRegistration))
+	router.POST("/admin/impersonate/stop", requireAuth(h.handleStopImpersonating))
+
+	// these routes require an instance admin
+	router.GET("/admin", h.requireAdmin(h.handleAdmin))
+	router.POST("/admin/users/:id/disable", h.requireAdmin(h.handleSetDisabled(true)))
+	router.POST("/admin/users/:id/enable", h.requireAdmin(h.handleSetDisabled(false)))
+	router.POST("/admin/users/:id/impersonate", h.requireAdmin(h.handleImpersonate))
+	if backupService != nil {
+		router.POST("/admin/backups", h.requireAdmin(h.handlePostBackup))
+		router.GET("/admin/backups/:name", h.requireAdmin(h.handleDownloadBackup))
+	}
 
-	mux.Handle("/", authService.Middleware(router))
+	mux.Handle("/", authService.Middleware(h.csrfMiddleware(impersonationMiddleware(router))))
 	mux.Handle("/assets/", http.FileServer(http.FS(assetsFS)))
 
 	router.NotFound = http.HandlerFunc(handleNotFound)
@@ -79,13 +129,41 @@ func requireAuth(handle httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		userId := UserFromFromContext(r.Context()).UserID
 		if userId == 0 {
-			http.Redirect(w, r, fmt.Sprintf("/login?next=%s", r.URL.Path), http.StatusSeeOther)
+			http.Redirect(w, r, loginURL(r), http.StatusSeeOther)
 			return
 		}
 		handle(w, r, p)
 	}
 }
 
+// requireAdmin answers not found to everyone but admins, so the admin area
+// isn't advertised.
+func (h *Handler) requireAdmin(handle httprouter.Handle) httprouter.Handle {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		admin, err := h.AdminService.IsAdmin(r.Context())
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		if !admin {
+			handleNotFound(w, r)
+			return
+		}
+		handle(w, r, p)
+	})
+}
+
+// impersonationMiddleware lets every page show when an admin is acting as
+// someone else.
+func impersonationMiddleware(handle http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ImpersonatorFromContext(r.Context()) != 0 {
+			r = r.WithContext(templates.WithImpersonating(r.Context()))
+		}
+		handle.ServeHTTP(w, r)
+	})
+}
+
 func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	userId := UserFromFromContext(r.Context()).UserID
 	if userId == 0 {
@@ -101,7 +179,7 @@ func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request, p httprout
 }
 
 func (h *Handler) handleGetLogin(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	templates.Login("", "", r.FormValue("next")).Render(r.Context(), w)
+	templates.Login("", "", SafeRedirect(r.FormValue("next")), h.OIDCService != nil).Render(r.Context(), w)
 }
 
 func (h *Handler) handlePostLogin(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -110,33 +188,28 @@ func (h *Handler) handlePostLogin(w http.ResponseWriter, r *http.Request, p http
 	output, err := h.AuthService.Login(r.Context(), AuthInput{
 		UserName: userName,
 		Password: password,
+		RemoteIP: remoteIP(r),
 	})
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
+	if output.RetryAfter > 0 {
+		setRetryAfter(w, output.RetryAfter)
+		templates.Login("Too many attempts, try again later", userName, SafeRedirect(r.FormValue("next")), h.OIDCService != nil).Render(r.Context(), w)
+		return
+	}
 	if !output.OK {
 		w.WriteHeader(http.StatusUnauthorized)
-		templates.Login("Invalid email and/or password", userName, r.FormValue("next")).Render(r.Context(), w)
+		templates.Login("Invalid email and/or password", userName, SafeRedirect(r.FormValue("next")), h.OIDCService != nil).Render(r.Context(), w)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    output.Token,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-		Expires:  time.Now().AddDate(0, 0, 30),
-		Secure:   h.UseTLS,
-	})
-	redirect := r.FormValue("next")
-	if redirect == "" {
-		redirect = "/"
-	}
-	http.Redirect(w, r, redirect, http.StatusFound)
+	h.setTokenCookie(w, output.Token)
+	http.Redirect(w, r, SafeRedirect(r.FormValue("next")), http.StatusFound)
 }
 
 func (h *Handler) handleGetSignup(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	templates.Signup("", "").Render(r.Context(), w)
+	templates.Signup("", nil, nil, "", SafeRedirect(r.FormValue("next"))).Render(r.Context(), w)
 }
 
 func (h *Handler) handlePostSignup(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -144,44 +217,82 @@ func (h *Handler) handlePostSignup(w http.ResponseWriter, r *http.Request, p htt
 	password := r.FormValue("password")
 	if userName == "" || password == "" {
 		w.WriteHeader(http.StatusBadRequest)
-		templates.Signup("Missing required values", userName).Render(r.Context(), w)
+		templates.Signup("Missing required values", nil, nil, userName, SafeRedirect(r.FormValue("next"))).Render(r.Context(), w)
 		return
 	}
 	output, err := h.AuthService.Signup(r.Context(), AuthInput{
 		UserName: userName,
 		Password: password,
+		RemoteIP: remoteIP(r),
 	})
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
+	if output.RetryAfter > 0 {
+		setRetryAfter(w, output.RetryAfter)
+		templates.Signup("Too many attempts, try again later", nil, nil, userName, SafeRedirect(r.FormValue("next"))).Render(r.Context(), w)
+		return
+	}
+	if len(output.UsernameErrors) > 0 || len(output.PasswordErrors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		templates.Signup("", output.UsernameErrors, output.PasswordErrors, userName, SafeRedirect(r.FormValue("next"))).Render(r.Context(), w)
+		return
+	}
 	if !output.OK {
 		w.WriteHeader(http.StatusUnauthorized)
-		templates.Signup("Username already claimed", userName).Render(r.Context(), w)
+		templates.Signup("Username already claimed", nil, nil, userName, SafeRedirect(r.FormValue("next"))).Render(r.Context(), w)
 		return
 	}
+	h.setTokenCookie(w, output.Token)
+	http.Redirect(w, r, SafeRedirect(r.FormValue("next")), http.StatusFound)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// setTokenCookie sets the session cookie and hands out a new CSRF token with
+// it, so a token planted or seen before someone logs in or out is no use
+// after.
+func (h *Handler) setTokenCookie(w http.ResponseWriter, token string) {
+	h.setCookie(w, "token", token)
+	// an empty token makes the next request hand out a new one
+	csrfToken, _ := newCSRFToken()
+	h.setCSRFCookie(w, csrfToken)
+}
+
+// setCookie sets a cookie that holds a session token, an empty value expires
+// it instead.
+func (h *Handler) setCookie(w http.ResponseWriter, name, value string) {
+	expires := time.Now().AddDate(0, 0, 30)
+	if value == "" {
+		expires = time.Unix(0, 0)
+	}
 	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    output.Token,
+		Name:     name,
+		Value:    value,
+		Path:     "/",
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
-		Expires:  time.Now().AddDate(0, 0, 30),
+		Expires:  expires,
 		Secure:   h.UseTLS,
 	})
-	redirect := r.FormValue("next")
-	if redirect == "" {
-		redirect = "/"
-	}
-	http.Redirect(w, r, redirect, http.StatusFound)
 }
 
 func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	cookie, err := r.Cookie("token")
-	if err == nil {
+	if _, err := r.Cookie("token"); err == nil {
 		// clear and expire the cookie
-		cookie.Value = ""
-		cookie.Expires = time.Unix(0, 0)
-		http.SetCookie(w, cookie)
+		h.setTokenCookie(w, "")
 	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -323,8 +434,432 @@ func (h *Handler) handleDeleteDial(w http.ResponseWriter, r *http.Request, p htt
 	http.Redirect(w, r, "/dials", http.StatusSeeOther)
 }
 
+func (h *Handler) handleGetPassword(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	templates.Password("", nil, false).Render(r.Context(), w)
+}
+
+func (h *Handler) handlePostPassword(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	output, err := h.AuthService.ChangePassword(r.Context(), ChangePasswordInput{
+		CurrentPassword: r.FormValue("currentPassword"),
+		NewPassword:     r.FormValue("newPassword"),
+	})
+	if err == ErrImpersonating {
+		handleForbidden(w, r)
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if output.RetryAfter > 0 {
+		setRetryAfter(w, output.RetryAfter)
+		templates.Password("Too many attempts, try again later", nil, false).Render(r.Context(), w)
+		return
+	}
+	if len(output.PasswordErrors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		templates.Password("", output.PasswordErrors, false).Render(r.Context(), w)
+		return
+	}
+	if !output.OK {
+		w.WriteHeader(http.StatusUnauthorized)
+		templates.Password("Current password is incorrect", nil, false).Render(r.Context(), w)
+		return
+	}
+	templates.Password("", nil, true).Render(r.Context(), w)
+}
+
+func (h *Handler) handleGetAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.UserService.Get(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	templates.Account(user.UserName, "").Render(r.Context(), w)
+}
+
+func (h *Handler) handleExportAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.UserService.Get(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	// an account's data is small, buffering it means a failure can still be
+	// answered with an error page rather than a broken download
+	var export bytes.Buffer
+	if err := h.UserService.WriteExport(r.Context(), &export); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="dials-%s.zip"`, user.UserName))
+	w.Header().Set("Content-Length", strconv.Itoa(export.Len()))
+	if _, err := export.WriteTo(w); err != nil {
+		slog.ErrorContext(r.Context(), "cannot send export", "err", err)
+	}
+}
+
+func (h *Handler) handleDeleteAccount(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := h.UserService.Delete(r.Context(), r.FormValue("confirmUserName"))
+	if err == ErrImpersonating {
+		handleForbidden(w, r)
+		return
+	}
+	if err == ErrDeleteConfirmation {
+		user, err := h.UserService.Get(r.Context())
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		templates.Account(user.UserName, "Type your username to confirm").Render(r.Context(), w)
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	h.setTokenCookie(w, "")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (h *Handler) renderEmail(w http.ResponseWriter, r *http.Request, errorMsg, notice string) {
+	user, err := h.UserService.Get(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	templates.Email(user.Email.String, user.EmailVerifiedAt.Valid, errorMsg, notice).Render(r.Context(), w)
+}
+
+func (h *Handler) handleGetEmail(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	h.renderEmail(w, r, "", "")
+}
+
+func (h *Handler) handlePostEmail(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	email := r.FormValue("email")
+	err := h.EmailService.SetEmail(r.Context(), email)
+	if err == ErrImpersonating {
+		handleForbidden(w, r)
+		return
+	}
+	if err == ErrInvalidEmail {
+		w.WriteHeader(http.StatusBadRequest)
+		templates.Email(email, false, "Invalid email address", "").Render(r.Context(), w)
+		return
+	}
+	if err == ErrTooManyEmails {
+		w.WriteHeader(http.StatusTooManyRequests)
+		templates.Email(email, false, "Too many emails were sent, try again later", "").Render(r.Context(), w)
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if email == "" {
+		h.renderEmail(w, r, "", "Your email has been removed")
+		return
+	}
+	h.renderEmail(w, r, "", "Check your inbox for a link to verify your email")
+}
+
+func (h *Handler) handleResendEmail(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := h.EmailService.Resend(r.Context())
+	if err == ErrTooManyEmails {
+		w.WriteHeader(http.StatusTooManyRequests)
+		h.renderEmail(w, r, "Too many emails were sent, try again later", "")
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	h.renderEmail(w, r, "", "Check your inbox for a link to verify your email")
+}
+
+func (h *Handler) handleVerifyEmail(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	ok, err := h.EmailService.Verify(r.Context(), r.FormValue("token"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	templates.EmailVerified(ok, UserFromFromContext(r.Context()).UserID != 0).Render(r.Context(), w)
+}
+
+func (h *Handler) renderAdmin(w http.ResponseWriter, r *http.Request, errorMsg string) {
+	overview, err := h.AdminService.Overview(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	tables := make([]templates.TableSize, len(overview.TableSizes))
+	for i, table := range overview.TableSizes {
+		tables[i] = templates.TableSize{Name: table.Name, Rows: table.Rows}
+	}
+	list, err := h.BackupService.List(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	var backups []templates.Backup
+	for _, backup := range list {
+		backups = append(backups, templates.Backup{Name: backup.Name, Size: backup.Size, CreatedAt: backup.CreatedAt})
+	}
+	templates.Admin(overview.Users, overview.Teams, tables, overview.Size, backups, overview.Audit, errorMsg).Render(r.Context(), w)
+}
+
+func (h *Handler) handleAdmin(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	h.renderAdmin(w, r, "")
+}
+
+func (h *Handler) handleSetDisabled(disabled bool) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		userID, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+		if err != nil {
+			handleNotFound(w, r)
+			return
+		}
+		err = h.AdminService.SetDisabled(r.Context(), userID, disabled)
+		if err == ErrAdminSelf {
+			w.WriteHeader(http.StatusBadRequest)
+			h.renderAdmin(w, r, "You can't disable yourself")
+			return
+		}
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	}
+}
+
+func (h *Handler) handleImpersonate(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	userID, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		handleNotFound(w, r)
+		return
+	}
+	token, err := h.AdminService.Impersonate(r.Context(), userID)
+	if err == ErrAdminSelf || err == errAccountDisabled || err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusBadRequest)
+		h.renderAdmin(w, r, "You can't impersonate that user")
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	// the admin's own session is put aside and restored when they stop
+	if cookie, err := r.Cookie("token"); err == nil {
+		h.setCookie(w, "admin_token", cookie.Value)
+	}
+	h.setTokenCookie(w, token)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (h *Handler) handlePostBackup(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	path, err := h.BackupService.Backup(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if err := h.AdminService.Record(r.Context(), "backed up to "+filepath.Base(path)); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+// handleDownloadBackup sends a backup, a copy of every account, so every
+// download is audited.
+func (h *Handler) handleDownloadBackup(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	name := p.ByName("name")
+	file, err := h.BackupService.Open(r.Context(), name)
+	if err == ErrBackupNotFound {
+		handleNotFound(w, r)
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer file.Close()
+	if err := h.AdminService.Record(r.Context(), "downloaded backup "+name); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	// the response has started, a failure can only be logged
+	if _, err := io.Copy(w, file); err != nil {
+		slog.ErrorContext(r.Context(), "cannot send backup", "backup", name, "err", err)
+	}
+}
+
+func (h *Handler) handleStopImpersonating(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	cookie, err := r.Cookie("token")
+	if err != nil || ImpersonatorFromContext(r.Context()) == 0 {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err := h.AdminService.StopImpersonating(r.Context(), cookie.Value); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	adminToken, err := r.Cookie("admin_token")
+	if err != nil {
+		h.setTokenCookie(w, "")
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	h.setTokenCookie(w, adminToken.Value)
+	h.setCookie(w, "admin_token", "")
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+// the webauthn cookie carries the ceremony id between the begin and finish
+// requests of a passkey registration or login
+func (h *Handler) setCeremonyCookie(w http.ResponseWriter, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "webauthn",
+		Value:    id,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(5 * time.Minute),
+		Secure:   h.UseTLS,
+	})
+}
+
+func ceremonyID(r *http.Request) string {
+	cookie, err := r.Cookie("webauthn")
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handler) handleGetPasskeys(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	passkeys, err := h.WebAuthnService.List(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	templates.Passkeys(passkeys).Render(r.Context(), w)
+}
+
+func (h *Handler) handleBeginPasskeyRegistration(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, creation, err := h.WebAuthnService.BeginRegistration(r.Context())
+	if err == ErrImpersonating {
+		handleForbidden(w, r)
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	h.setCeremonyCookie(w, id)
+	writeJSON(w, creation)
+}
+
+func (h *Handler) handleFinishPasskeyRegistration(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := h.WebAuthnService.FinishRegistration(r.Context(), ceremonyID(r), r.Body)
+	if err == ErrImpersonating {
+		handleForbidden(w, r)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, ErrWebAuthnCeremony) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleBeginPasskeyLogin(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, assertion, err := h.WebAuthnService.BeginLogin(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	h.setCeremonyCookie(w, id)
+	writeJSON(w, assertion)
+}
+
+func (h *Handler) handleFinishPasskeyLogin(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	output, err := h.WebAuthnService.FinishLogin(r.Context(), ceremonyID(r), r.Body)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if !output.OK {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.setTokenCookie(w, output.Token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleGetOIDCLogin(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	url, state, err := h.OIDCService.AuthCodeURL(r.Context(), SafeRedirect(r.FormValue("next")))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	// the state cookie ties the callback to the browser that started the
+	// flow. it has to be lax, the callback is a cross-site navigation.
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc",
+		Value:    state,
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(10 * time.Minute),
+		Secure:   h.UseTLS,
+	})
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+func (h *Handler) handleOIDCCallback(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	state := r.FormValue("state")
+	cookie, err := r.Cookie("oidc")
+	if err != nil || cookie.Value != state || r.FormValue("code") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		templates.Login("Single sign-on failed", "", "/", true).Render(r.Context(), w)
+		return
+	}
+	output, next, err := h.OIDCService.Callback(r.Context(), state, r.FormValue("code"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if !output.OK {
+		w.WriteHeader(http.StatusUnauthorized)
+		templates.Login("Single sign-on failed", "", SafeRedirect(next), true).Render(r.Context(), w)
+		return
+	}
+	h.setTokenCookie(w, output.Token)
+	// the strict token cookie isn't sent on a redirect that started on the
+	// provider's site, so leave this page with a same-site navigation
+	templates.Redirect(SafeRedirect(next)).Render(r.Context(), w)
+}
+
+// handleError logs err, or what a handler panicked with, and answers with
+// the error page.
 func handleError(w http.ResponseWriter, r *http.Request, err interface{}) {
 	ctx := r.Context()
+	slog.ErrorContext(ctx, "request failed", "method", r.Method, "path", r.URL.Path, "err", err)
 	w.WriteHeader(http.StatusInternalServerError)
 	templates.Error(UserFromFromContext(ctx).UserID != 0).Render(ctx, w)
 }
@@ -334,3 +869,11 @@ func handleNotFound(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 	templates.NotFound(UserFromFromContext(ctx).UserID != 0).Render(ctx, w)
 }
+
+// handleForbidden answers requests for something the user can't do, like
+// changing the password of an account they're impersonating.
+func handleForbidden(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.WriteHeader(http.StatusForbidden)
+	templates.Forbidden(UserFromFromContext(ctx).UserID != 0).Render(ctx, w)
+}
@@ -0,0 +1,349 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sqlite/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrJobRunning is returned by Scheduler.RunNow when the job is already
+// running.
+var ErrJobRunning = errors.New("job is already running")
+
+// keepJobRuns is how many runs of each job are kept in the history.
+const keepJobRuns = 100
+
+// Schedule says when a job runs next.
+type Schedule interface {
+	// Next returns the first time after t the job runs, or the zero time if
+	// it never does.
+	Next(t time.Time) time.Time
+}
+
+// ParseSchedule parses a cron spec with the five fields minute, hour, day of
+// month, month and day of week, each *, a number, a range like 1-5, a step
+// like */15 or 1-30/2, or a list of those like 0,30. It also takes @hourly,
+// @daily, @weekly and @monthly, and @every followed by a duration like 10m.
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if every, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q", spec)
+		}
+		return everySchedule(interval), nil
+	}
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 fields", spec)
+	}
+	var s cronSchedule
+	for i, field := range []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.day, 1, 31},
+		{&s.month, 1, 12},
+		{&s.weekday, 0, 6},
+	} {
+		set, err := parseCronField(fields[i], field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		*field.set = set
+	}
+	// as in cron, a day matches either restricted day field
+	s.anyDay, s.anyWeekday = fields[2] == "*", fields[4] == "*"
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if from, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if hasStep {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+type cronSchedule struct {
+	minute, hour, day, month, weekday uint64
+	anyDay, anyWeekday                bool
+}
+
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	day := s.day&(1<<t.Day()) != 0
+	weekday := s.weekday&(1<<t.Weekday()) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+func (s cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a spec like "0 0 30 2 *" never matches, give up after a few years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			// not Truncate, which rounds in UTC and would land on the half
+			// hour in zones like India's
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+type everySchedule time.Duration
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// Job is work the scheduler runs in the background.
+type Job struct {
+	// Name identifies the job in the history, the metrics and the logs.
+	Name string
+	// Schedule is a spec for ParseSchedule.
+	Schedule string
+	// Jitter delays every run by up to this much, so several servers don't
+	// all run the job at once.
+	Jitter time.Duration
+	// Run does the work. Its context is cancelled when the scheduler stops.
+	Run func(ctx context.Context) error
+}
+
+type scheduledJob struct {
+	Job
+	schedule Schedule
+}
+
+// Scheduler runs jobs on their schedules, one run of a job at a time, and
+// records every run in the job_run table.
+type Scheduler struct {
+	db *DB
+
+	mu      sync.Mutex
+	jobs    []*scheduledJob
+	running map[string]bool
+	wg      sync.WaitGroup
+}
+
+func NewScheduler(db *DB) *Scheduler {
+	return &Scheduler{
+		db:      db,
+		running: map[string]bool{},
+	}
+}
+
+// Register adds a job, before Run is called.
+func (s *Scheduler) Register(job Job) error {
+	schedule, err := ParseSchedule(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("cannot register job %s: %w", job.Name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, registered := range s.jobs {
+		if registered.Name == job.Name {
+			return fmt.Errorf("job %s is already registered", job.Name)
+		}
+	}
+	s.jobs = append(s.jobs, &scheduledJob{Job: job, schedule: schedule})
+	return nil
+}
+
+// Run schedules the registered jobs until ctx is done, then waits for the
+// runs in progress, which see their context cancelled, to finish.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	for _, job := range s.jobs {
+		s.start(ctx, job)
+	}
+	s.mu.Unlock()
+	<-ctx.Done()
+	s.wg.Wait()
+}
+
+// start runs the job on its schedule in a goroutine of its own.
+func (s *Scheduler) start(ctx context.Context, job *scheduledJob) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			next := job.schedule.Next(time.Now())
+			if next.IsZero() {
+				slog.WarnContext(ctx, "job: the schedule never runs it", "job", job.Name)
+				return
+			}
+			wait := time.Until(next)
+			if job.Jitter > 0 {
+				wait += time.Duration(rand.Int63n(int64(job.Jitter)))
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if err := s.run(ctx, job); err == ErrJobRunning {
+				slog.WarnContext(ctx, "job: skipped, the last run hasn't finished", "job", job.Name)
+				jobRuns.WithLabelValues(job.Name, "skipped").Inc()
+			}
+		}
+	}()
+}
+
+// RunNow runs the job right away and waits for it, unless it's running
+// already.
+func (s *Scheduler) RunNow(ctx context.Context, name string) error {
+	s.mu.Lock()
+	var job *scheduledJob
+	for _, registered := range s.jobs {
+		if registered.Name == name {
+			job = registered
+		}
+	}
+	s.mu.Unlock()
+	if job == nil {
+		return fmt.Errorf("no job %s", name)
+	}
+	return s.run(ctx, job)
+}
+
+// run runs the job and records how it went, unless it's running already.
+func (s *Scheduler) run(ctx context.Context, job *scheduledJob) error {
+	s.mu.Lock()
+	if s.running[job.Name] {
+		s.mu.Unlock()
+		return ErrJobRunning
+	}
+	s.running[job.Name] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, job.Name)
+		s.mu.Unlock()
+	}()
+
+	started := time.Now()
+	// the history is only for people to look at, it doesn't stop the job
+	id, recordErr := s.db.Queries.CreateJobRun(ctx, model.CreateJobRunParams{Job: job.Name, StartedAt: started.UTC()})
+	if recordErr != nil {
+		slog.ErrorContext(ctx, "job: cannot record run", "job", job.Name, "err", recordErr)
+	}
+	err := job.Run(ctx)
+	elapsed := time.Since(started)
+	jobDuration.WithLabelValues(job.Name).Observe(elapsed.Seconds())
+	if err != nil {
+		slog.ErrorContext(ctx, "job: failed", "job", job.Name, "duration", elapsed.Round(time.Millisecond), "err", err)
+		jobRuns.WithLabelValues(job.Name, "failed").Inc()
+	} else {
+		jobRuns.WithLabelValues(job.Name, "ok").Inc()
+		jobLastSuccess.WithLabelValues(job.Name).SetToCurrentTime()
+	}
+
+	if recordErr == nil {
+		// the run is recorded even when it was cancelled by a shutdown
+		ctx := context.WithoutCancel(ctx)
+		finished := model.FinishJobRunParams{
+			FinishedAt: sql.NullTime{Time: time.Now().UTC(), Valid: true},
+			ID:         id,
+		}
+		if err != nil {
+			finished.Error = sql.NullString{String: err.Error(), Valid: true}
+		}
+		if err := s.db.Queries.FinishJobRun(ctx, finished); err != nil {
+			slog.ErrorContext(ctx, "job: cannot record run", "job", job.Name, "err", err)
+		} else if err := s.db.Queries.PruneJobRuns(ctx, model.PruneJobRunsParams{Job: job.Name, Job_2: job.Name, Offset: keepJobRuns}); err != nil {
+			slog.ErrorContext(ctx, "job: cannot prune runs", "job", job.Name, "err", err)
+		}
+	}
+	return err
+}
+
+// JobRun is a run of a job from the history.
+type JobRun struct {
+	Job        string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Error is why the run failed, empty if it didn't.
+	Error string
+}
+
+// History returns the last runs of every job, newest first. Runs still in
+// progress have no FinishedAt.
+func (s *Scheduler) History(ctx context.Context, limit int) ([]JobRun, error) {
+	rows, err := s.db.ReadQueries.ListJobRuns(ctx, int64(limit))
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]JobRun, 0, len(rows))
+	for _, row := range rows {
+		runs = append(runs, JobRun{
+			Job:        row.Job,
+			StartedAt:  row.StartedAt,
+			FinishedAt: row.FinishedAt.Time,
+			Error:      row.Error.String,
+		})
+	}
+	return runs, nil
+}
@@ -0,0 +1,239 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sqlite"
+	"sqlite/model"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// a Tuesday
+	from := time.Date(2026, 10, 20, 13, 37, 20, 0, time.UTC)
+	for spec, expected := range map[string]string{
+		"* * * * *":        "2026-10-20 13:38",
+		"*/15 * * * *":     "2026-10-20 13:45",
+		"0,30 9-17 * * *":  "2026-10-20 14:00",
+		"30 3 * * *":       "2026-10-21 03:30",
+		"0 4 * * 0":        "2026-10-25 04:00",
+		"0 0 1 * *":        "2026-11-01 00:00",
+		"0 0 29 2 *":       "2028-02-29 00:00",
+		"0 12 1 * 1-5":     "2026-10-21 12:00",
+		"5-59/20 * * 11 *": "2026-11-01 00:05",
+		"@daily":           "2026-10-21 00:00",
+		"@every 90m":       "2026-10-20 15:07",
+	} {
+		schedule, err := sqlite.ParseSchedule(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if next := schedule.Next(from).Format("2006-01-02 15:04"); next != expected {
+			t.Fatalf("%s: expected %s, got %s", spec, expected, next)
+		}
+	}
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@every -1m", "@sometimes"} {
+		if _, err := sqlite.ParseSchedule(spec); err == nil {
+			t.Fatalf("expected %q to be invalid", spec)
+		}
+	}
+	// hours start on the hour of the local clock, whatever the offset
+	kolkata := time.FixedZone("IST", 5*60*60+30*60)
+	for spec, expected := range map[string]string{
+		"0 4 * * *": "2026-10-19 04:00",
+		"0 4 * * 0": "2026-10-25 04:00",
+	} {
+		schedule, _ := sqlite.ParseSchedule(spec)
+		if next := schedule.Next(time.Date(2026, 10, 19, 2, 45, 0, 0, kolkata)).Format("2006-01-02 15:04"); next != expected {
+			t.Fatalf("%s in Kolkata: expected %s, got %s", spec, expected, next)
+		}
+	}
+	never, _ := sqlite.ParseSchedule("0 0 30 2 *")
+	if next := never.Next(from); !next.IsZero() {
+		t.Fatalf("expected February 30th to never come, got %v", next)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+	scheduler := sqlite.NewScheduler(db)
+
+	var ticks atomic.Int64
+	started, release := make(chan struct{}), make(chan struct{})
+	var stopped atomic.Bool
+	for _, job := range []sqlite.Job{
+		{Name: "tick", Schedule: "@every 10ms", Run: func(ctx context.Context) error {
+			ticks.Add(1)
+			return nil
+		}},
+		{Name: "fail", Schedule: "@daily", Run: func(ctx context.Context) error {
+			return errors.New("no luck")
+		}},
+		{Name: "slow", Schedule: "@daily", Run: func(ctx context.Context) error {
+			close(started)
+			<-release
+			<-ctx.Done()
+			stopped.Store(true)
+			return ctx.Err()
+		}},
+	} {
+		if err := scheduler.Register(job); err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	if err := scheduler.Register(sqlite.Job{Name: "tick", Schedule: "@hourly"}); err == nil {
+		t.Fatal("expected names to be unique")
+	}
+	if err := scheduler.Register(sqlite.Job{Name: "bad", Schedule: "every now and then"}); err == nil {
+		t.Fatal("expected the schedule to be checked")
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		scheduler.Run(runCtx)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); ticks.Load() < 3 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ticks.Load() < 3 {
+		t.Fatalf("expected the job to run every 10ms, ran %d times", ticks.Load())
+	}
+	if err := scheduler.RunNow(ctx, "fail"); err == nil || err.Error() != "no luck" {
+		t.Fatalf("expected the job's error, got %v", err)
+	}
+
+	// one run at a time
+	slowErr := make(chan error)
+	go func() { slowErr <- scheduler.RunNow(runCtx, "slow") }()
+	<-started
+	if err := scheduler.RunNow(ctx, "slow"); err != sqlite.ErrJobRunning {
+		t.Fatalf("expected ErrJobRunning, got %v", err)
+	}
+
+	// stopping waits for the run in progress, which sees its context done
+	stop()
+	close(release)
+	<-done
+	if err := <-slowErr; err != context.Canceled || !stopped.Load() {
+		t.Fatalf("expected the slow job to be cancelled, got %v", err)
+	}
+
+	runs, err := scheduler.History(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	failed := map[string]string{}
+	for _, run := range runs {
+		if run.FinishedAt.IsZero() {
+			t.Fatalf("expected every run to have finished, got %+v", run)
+		}
+		if run.Error != "" {
+			failed[run.Job] = run.Error
+		}
+	}
+	if len(runs) < 5 || failed["fail"] != "no luck" || failed["slow"] != context.Canceled.Error() || failed["tick"] != "" {
+		t.Fatalf("expected the runs and their errors in the history, got %+v", runs)
+	}
+}
+
+func TestMaintenanceJobs(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "app.db")
+	db, err := sqlite.CreateAndMigrateDb(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer db.Close()
+
+	// deleted users leave free pages behind for the vacuum
+	for i := 0; i < 200; i++ {
+		_, err := db.Queries.CreateUser(ctx, model.CreateUserParams{
+			UserName:         fmt.Sprintf("user%d", i),
+			UserNameSkeleton: fmt.Sprintf("user%d", i),
+			Password:         make([]byte, 4000),
+		})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	other, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	_, err = other.ExecContext(ctx, `delete from user`)
+	other.Close()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	before, err := db.Size(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	for _, job := range sqlite.MaintenanceJobs(db, sqlite.MaintenanceConfig{}) {
+		if err := job.Run(ctx); err != nil {
+			t.Fatalf("%s: %v", job.Name, err)
+		}
+	}
+	after, err := db.Size(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if after >= before/2 {
+		t.Fatalf("expected the vacuum to give the free pages back, from %d to %d bytes", before, after)
+	}
+
+	for _, session := range []model.CreateWebAuthnSessionParams{
+		{ID: "expired", Data: []byte("{}"), ExpiresAt: time.Now().UTC().Add(-time.Minute)},
+		{ID: "current", Data: []byte("{}"), ExpiresAt: time.Now().UTC().Add(time.Minute)},
+	} {
+		if err := db.Queries.CreateWebAuthnSession(ctx, session); err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	// rate limited keys are forgotten after a day
+	for key, at := range map[string]time.Time{"ip:stale": time.Now().Add(-48 * time.Hour), "ip:recent": time.Now()} {
+		_, err := db.Queries.RecordLoginFailure(ctx, model.RecordLoginFailureParams{Key: key, Now: at.Unix()})
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	if err := sqlite.NewAuthService(db, sqlite.AuthConfig{}).PurgeExpired(ctx); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if _, err := db.Queries.TakeWebAuthnSession(ctx, "expired"); err != sql.ErrNoRows {
+		t.Fatalf("expected the expired session to be purged, got %v", err)
+	}
+	if _, err := db.Queries.TakeWebAuthnSession(ctx, "current"); err != nil {
+		t.Fatalf("expected the current session to be kept, got %v", err)
+	}
+	if _, err := db.Queries.GetLoginAttempt(ctx, "ip:stale"); err != sql.ErrNoRows {
+		t.Fatalf("expected the stale login attempt to be purged, got %v", err)
+	}
+	if _, err := db.Queries.GetLoginAttempt(ctx, "ip:recent"); err != nil {
+		t.Fatalf("expected the recent login attempt to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package templates
+
+import (
+	"context"
+	"time"
+)
+
+type TableSize struct {
+	Name string
+	Rows int64
+}
+
+type Backup struct {
+	Name      string
+	Size      int64
+	CreatedAt time.Time
+}
+
+type impersonatingKey struct{}
+
+// WithImpersonating marks pages rendered with ctx as being viewed by an admin
+// acting as another user.
+func WithImpersonating(ctx context.Context) context.Context {
+	return context.WithValue(ctx, impersonatingKey{}, true)
+}
+
+func Impersonating(ctx context.Context) bool {
+	impersonating, _ := ctx.Value(impersonatingKey{}).(bool)
+	return impersonating
+}
@@ -0,0 +1,15 @@
+package templates
+
+import "context"
+
+type csrfKey struct{}
+
+// WithCSRFToken stores the token that forms rendered with ctx must submit.
+func WithCSRFToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, csrfKey{}, token)
+}
+
+func CSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfKey{}).(string)
+	return token
+}
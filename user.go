@@ -1,8 +1,14 @@
 package sqlite
 
 import (
+	"archive/zip"
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
 	"sqlite/model"
+	"time"
 )
 
 type UserService struct {
@@ -16,5 +22,199 @@ func NewUserService(db *DB) *UserService {
 }
 
 func (svc *UserService) Get(ctx context.Context) (model.User, error) {
-	return svc.db.Queries.GetUserById(ctx, UserFromFromContext(ctx).UserID)
+	return svc.db.readQueries(ctx).GetUserById(ctx, UserFromFromContext(ctx).UserID)
+}
+
+// ErrDeleteConfirmation is returned by Delete when the username typed to
+// confirm doesn't match.
+var ErrDeleteConfirmation = errors.New("confirmation doesn't match the username")
+
+// Delete removes the authenticated user and everything that belongs to
+// them. Teams the user is the only member of are deleted with them, shared
+// teams are left to their remaining members. Admins impersonating the user
+// can't delete it.
+func (svc *UserService) Delete(ctx context.Context, confirmUserName string) error {
+	if ImpersonatorFromContext(ctx) != 0 {
+		return ErrImpersonating
+	}
+	user, err := svc.Get(ctx)
+	if err != nil {
+		return err
+	}
+	if NormalizeUsername(confirmUserName) != user.UserName {
+		return ErrDeleteConfirmation
+	}
+	// rows are removed children first so foreign keys hold at every step
+	return svc.db.Transaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		teamIDs, err := q.ListSoleTeams(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		for _, step := range []func(context.Context, int64) error{
+			q.DeleteUserSessions,
+			q.DeleteImpersonationSessions,
+			q.DeleteUserTeamUsers,
+			q.DeleteUserDials,
+			q.DeleteUserWebAuthnCredentials,
+			q.DeleteUserOIDCIdentities,
+			q.DeleteEmailVerifications,
+		} {
+			if err := step(ctx, user.ID); err != nil {
+				return err
+			}
+		}
+		for _, teamID := range teamIDs {
+			if err := q.DeleteTeam(ctx, teamID); err != nil {
+				return err
+			}
+		}
+		if err := q.ClearUserAdminAudit(ctx, sql.NullInt64{Int64: user.ID, Valid: true}); err != nil {
+			return err
+		}
+		if err := q.DeleteLoginAttempt(ctx, "user:"+user.UserName); err != nil {
+			return err
+		}
+		return q.DeleteUser(ctx, user.ID)
+	})
+}
+
+// Export is everything stored about a user. Secrets like the password hash
+// and session tokens are left out.
+type Export struct {
+	User struct {
+		UserName      string     `json:"user_name"`
+		Email         string     `json:"email,omitempty"`
+		EmailVerified bool       `json:"email_verified"`
+		IsAdmin       bool       `json:"is_admin"`
+		DisabledAt    *time.Time `json:"disabled_at,omitempty"`
+		CreatedAt     time.Time  `json:"created_at"`
+	} `json:"user"`
+	Teams []ExportTeam `json:"teams"`
+	Dials []ExportDial `json:"dials"`
+	// Passkeys only lists when they were added, the keys are useless
+	// outside this site.
+	Passkeys   []ExportPasskey  `json:"passkeys"`
+	Identities []ExportIdentity `json:"identities"`
+	Sessions   []ExportSession  `json:"sessions"`
+}
+
+type ExportTeam struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportDial struct {
+	Name       string    `json:"name"`
+	Value      int64     `json:"value"`
+	CreatedAt  time.Time `json:"created_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+type ExportPasskey struct {
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportSession struct {
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Impersonated bool      `json:"impersonated"`
+}
+
+func (svc *UserService) Export(ctx context.Context) (Export, error) {
+	// empty lists are [] rather than null in the json
+	export := Export{
+		Teams:      []ExportTeam{},
+		Dials:      []ExportDial{},
+		Passkeys:   []ExportPasskey{},
+		Identities: []ExportIdentity{},
+		Sessions:   []ExportSession{},
+	}
+	// one snapshot, so the parts of the export agree with each other
+	err := svc.db.ReadTransaction(ctx, func(ctx context.Context, q *model.Queries) error {
+		user, err := q.GetUserById(ctx, UserFromFromContext(ctx).UserID)
+		if err != nil {
+			return err
+		}
+		export.User.UserName = user.UserName
+		export.User.Email = user.Email.String
+		export.User.EmailVerified = user.EmailVerifiedAt.Valid
+		export.User.IsAdmin = user.IsAdmin
+		if user.DisabledAt.Valid {
+			export.User.DisabledAt = &user.DisabledAt.Time
+		}
+		export.User.CreatedAt = user.CreatedAt
+
+		teams, err := q.ListTeams(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		for _, team := range teams {
+			export.Teams = append(export.Teams, ExportTeam{Name: team.Team.Name, CreatedAt: team.Team.CreatedAt})
+		}
+		dials, err := q.ListDials(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		for _, dial := range dials {
+			export.Dials = append(export.Dials, ExportDial{
+				Name:       dial.Name,
+				Value:      dial.Value,
+				CreatedAt:  dial.CreatedAt,
+				ModifiedAt: dial.ModifiedAt,
+			})
+		}
+		passkeys, err := q.ListWebAuthnCredentials(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		for _, passkey := range passkeys {
+			export.Passkeys = append(export.Passkeys, ExportPasskey{CreatedAt: passkey.CreatedAt})
+		}
+		identities, err := q.ListUserOIDCIdentities(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		for _, identity := range identities {
+			export.Identities = append(export.Identities, ExportIdentity{
+				Issuer:    identity.Issuer,
+				Subject:   identity.Subject,
+				CreatedAt: identity.CreatedAt,
+			})
+		}
+		sessions, err := q.ListUserSessions(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			export.Sessions = append(export.Sessions, ExportSession(session))
+		}
+		return nil
+	})
+	return export, err
+}
+
+// WriteExport writes the export as a zip holding a single data.json, the
+// format people expect from a "download my data" button.
+func (svc *UserService) WriteExport(ctx context.Context, w io.Writer) error {
+	export, err := svc.Export(ctx)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(w)
+	file, err := archive.Create("data.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(export); err != nil {
+		return err
+	}
+	return archive.Close()
 }
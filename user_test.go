@@ -1,7 +1,11 @@
 package sqlite_test
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"sqlite"
 	"sqlite/model"
@@ -51,3 +55,126 @@ func TestUserService(t *testing.T) {
 		t.Fatalf("expected username test, got %s", user.UserName)
 	}
 }
+
+func TestUserServiceDelete(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	authService := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+	adminService := sqlite.NewAdminService(db)
+	dialService := sqlite.NewDialService(db)
+	svc := sqlite.NewUserService(db)
+	login := func(userName string) context.Context {
+		output, err := authService.Login(ctx, sqlite.AuthInput{
+			UserName: userName,
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		teamUser, err := authService.GetTeamUserFromSession(ctx, output.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sqlite.ContextWithUser(ctx, teamUser)
+	}
+	for _, userName := range []string{"alice", "bob"} {
+		if _, err := authService.Signup(ctx, sqlite.AuthInput{UserName: userName, Password: testPassword}); err != nil {
+			t.Fatal(err)
+			return
+		}
+	}
+	if err := adminService.GrantAdmin(ctx, "alice"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	alice, bob := login("alice"), login("bob")
+
+	// bob joins alice's team, makes a dial and shows up in the audit log
+	_, err = db.Queries.CreateTeamUser(ctx, model.CreateTeamUserParams{
+		TeamID: sqlite.UserFromFromContext(alice).TeamID,
+		UserID: sqlite.UserFromFromContext(bob).UserID,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if _, err := dialService.Create(bob, "test"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if err := adminService.SetDisabled(alice, sqlite.UserFromFromContext(bob).UserID, false); err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	export, err := svc.Export(bob)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if export.User.UserName != "bob" || len(export.Teams) != 2 || len(export.Dials) != 1 || len(export.Sessions) != 2 {
+		t.Fatalf("expected bob's user, 2 teams, 1 dial and 2 sessions, got %+v", export)
+	}
+	var buf bytes.Buffer
+	if err := svc.WriteExport(bob, &buf); err != nil {
+		t.Fatal(err)
+		return
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(archive.File) != 1 || archive.File[0].Name != "data.json" {
+		t.Fatal("expected the export to hold data.json")
+	}
+	file, err := archive.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	defer file.Close()
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(file).Decode(&decoded); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if _, ok := decoded["dials"]; !ok {
+		t.Fatalf("expected dials in the export, got %v", decoded)
+	}
+	if passkeys, ok := decoded["passkeys"].([]interface{}); !ok || len(passkeys) != 0 {
+		t.Fatalf("expected an empty list of passkeys, got %v", decoded["passkeys"])
+	}
+
+	if err := svc.Delete(bob, "alice"); err != sqlite.ErrDeleteConfirmation {
+		t.Fatalf("expected ErrDeleteConfirmation, got %v", err)
+	}
+	if err := svc.Delete(bob, "Bob"); err != nil {
+		t.Fatal(err)
+		return
+	}
+	if _, err := db.Queries.GetUserByUsername(ctx, "bob"); err != sql.ErrNoRows {
+		t.Fatalf("expected bob to be gone, got %v", err)
+	}
+	// bob's own team went with him, alice's stays
+	teams, err := db.Queries.ListAllTeams(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(teams) != 1 || teams[0].Name != "alice" || teams[0].MemberCount != 1 {
+		t.Fatalf("expected only alice's team to be left, got %+v", teams)
+	}
+	audit, err := db.Queries.ListAdminAudit(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(audit) != 1 || audit[0].AdminName.String != "alice" || audit[0].TargetName.Valid {
+		t.Fatalf("expected the audit entry to outlive bob, got %+v", audit)
+	}
+}
@@ -0,0 +1,101 @@
+package sqlite
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+)
+
+// reservedUsernames would be confusing or misleading as the name of a user.
+var reservedUsernames = map[string]bool{
+	"about":         true,
+	"account":       true,
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"assets":        true,
+	"dials":         true,
+	"help":          true,
+	"login":         true,
+	"logout":        true,
+	"me":            true,
+	"null":          true,
+	"passkeys":      true,
+	"root":          true,
+	"security":      true,
+	"settings":      true,
+	"signup":        true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+	"www":           true,
+}
+
+// NormalizeUsername folds compatibility characters (like fullwidth letters)
+// to their plain form with NFKC and lowercases the result. Every lookup by
+// username goes through it.
+func NormalizeUsername(userName string) string {
+	return strings.ToLower(strings.TrimSpace(norm.NFKC.String(userName)))
+}
+
+// CheckUsername normalizes a new username and returns a message for every
+// rule it breaks. Only lowercase ascii letters, digits and . _ - are allowed,
+// which rules out lookalikes from other scripts entirely.
+func CheckUsername(userName string) (string, []string) {
+	userName = NormalizeUsername(userName)
+	var problems []string
+	if len(userName) < minUsernameLength || len(userName) > maxUsernameLength {
+		problems = append(problems, "Username must be between 3 and 32 characters")
+	}
+	for _, r := range userName {
+		if !isUsernameLetter(r) && !isUsernameSeparator(r) {
+			problems = append(problems, "Username may only contain letters, digits, '.', '_' and '-'")
+			break
+		}
+	}
+	if userName != "" && (isUsernameSeparator(rune(userName[0])) || isUsernameSeparator(rune(userName[len(userName)-1]))) {
+		problems = append(problems, "Username must start and end with a letter or digit")
+	}
+	if isReservedUsername(userName) {
+		problems = append(problems, "Username is reserved")
+	}
+	return userName, problems
+}
+
+func isReservedUsername(userName string) bool {
+	skeleton := usernameSkeleton(userName)
+	for name := range reservedUsernames {
+		if usernameSkeleton(name) == skeleton {
+			return true
+		}
+	}
+	return false
+}
+
+func isUsernameLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+}
+
+func isUsernameSeparator(r rune) bool {
+	return r == '.' || r == '_' || r == '-'
+}
+
+// usernameSkeleton maps usernames that are easy to mistake for each other,
+// like "jane.doe" and "janed0e", to the same value. The replacements run in
+// order, changing them needs a migration recomputing the stored skeletons.
+func usernameSkeleton(userName string) string {
+	for _, r := range [][2]string{
+		{".", ""}, {"-", ""}, {"_", ""},
+		{"0", "o"}, {"1", "l"}, {"i", "l"},
+		{"rn", "m"}, {"vv", "w"},
+	} {
+		userName = strings.ReplaceAll(userName, r[0], r[1])
+	}
+	return userName
+}
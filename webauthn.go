@@ -0,0 +1,309 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sqlite/model"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofrs/uuid"
+)
+
+// ErrWebAuthnCeremony is returned when a registration or login ceremony is
+// unknown, expired, or the authenticator response doesn't verify.
+var ErrWebAuthnCeremony = errors.New("webauthn ceremony failed")
+
+type WebAuthnConfig struct {
+	RPID          string
+	RPDisplayName string
+	RPOrigins     []string
+}
+
+type WebAuthnService struct {
+	db       *DB
+	webAuthn *webauthn.WebAuthn
+}
+
+func NewWebAuthnService(db *DB, config WebAuthnConfig) (*WebAuthnService, error) {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          config.RPID,
+		RPDisplayName: config.RPDisplayName,
+		RPOrigins:     config.RPOrigins,
+		// the library checks the expiry it puts in the ceremony too
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true},
+			Registration: webauthn.TimeoutConfig{Enforce: true},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnService{
+		db:       db,
+		webAuthn: w,
+	}, nil
+}
+
+// webAuthnUser adapts a user and their stored credentials to webauthn.User.
+type webAuthnUser struct {
+	user        model.User
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(u.user.ID)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.UserName
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.UserName
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+// the user handle is the big endian user id, which lets discoverable logins
+// find the user without a username
+func webAuthnUserHandle(userID int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userID))
+}
+
+func (svc *WebAuthnService) loadUser(ctx context.Context, userID int64) (*webAuthnUser, error) {
+	user, err := svc.db.readQueries(ctx).GetUserById(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := svc.db.readQueries(ctx).ListWebAuthnCredentials(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make([]webauthn.Credential, 0, len(rows))
+	for _, row := range rows {
+		var transports []protocol.AuthenticatorTransport
+		if row.Transports != "" {
+			for _, t := range strings.Split(row.Transports, ",") {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              row.CredentialID,
+			PublicKey:       row.PublicKey,
+			AttestationType: row.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: row.BackupEligible,
+				BackupState:    row.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    row.Aaguid,
+				SignCount: uint32(row.SignCount),
+			},
+		})
+	}
+	return &webAuthnUser{
+		user:        user,
+		credentials: credentials,
+	}, nil
+}
+
+// saveCeremony stores the challenge state and returns the id the client must
+// present when finishing the ceremony.
+func (svc *WebAuthnService) saveCeremony(ctx context.Context, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	expiresAt := session.Expires
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(5 * time.Minute)
+	}
+	err = svc.db.queries(ctx).CreateWebAuthnSession(ctx, model.CreateWebAuthnSessionParams{
+		ID:        id.String(),
+		Data:      data,
+		ExpiresAt: expiresAt.UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// takeCeremony loads and deletes the challenge state so that every challenge
+// can only be answered once, and only until it expires.
+func (svc *WebAuthnService) takeCeremony(ctx context.Context, id string) (webauthn.SessionData, error) {
+	var session webauthn.SessionData
+	row, err := svc.db.queries(ctx).TakeWebAuthnSession(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return session, ErrWebAuthnCeremony
+		}
+		return session, err
+	}
+	if !time.Now().Before(row.ExpiresAt) {
+		return session, ErrWebAuthnCeremony
+	}
+	if err := json.Unmarshal(row.Data, &session); err != nil {
+		return session, err
+	}
+	return session, nil
+}
+
+// BeginRegistration starts adding a passkey to the authenticated user.
+// Admins impersonating the user can't add one, it would let them back in
+// after the impersonation ends.
+func (svc *WebAuthnService) BeginRegistration(ctx context.Context) (string, *protocol.CredentialCreation, error) {
+	if ImpersonatorFromContext(ctx) != 0 {
+		return "", nil, ErrImpersonating
+	}
+	user, err := svc.loadUser(ctx, UserFromFromContext(ctx).UserID)
+	if err != nil {
+		return "", nil, err
+	}
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+	for _, c := range user.credentials {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+	creation, session, err := svc.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := svc.saveCeremony(ctx, session)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, creation, nil
+}
+
+// FinishRegistration verifies the authenticator's attestation and stores the
+// new credential for the authenticated user, unless an admin is
+// impersonating them.
+func (svc *WebAuthnService) FinishRegistration(ctx context.Context, ceremonyID string, body io.Reader) error {
+	if ImpersonatorFromContext(ctx) != 0 {
+		return ErrImpersonating
+	}
+	session, err := svc.takeCeremony(ctx, ceremonyID)
+	if err != nil {
+		return err
+	}
+	user, err := svc.loadUser(ctx, UserFromFromContext(ctx).UserID)
+	if err != nil {
+		return err
+	}
+	response, err := protocol.ParseCredentialCreationResponseBody(body)
+	if err != nil {
+		return errors.Join(ErrWebAuthnCeremony, err)
+	}
+	credential, err := svc.webAuthn.CreateCredential(user, session, response)
+	if err != nil {
+		return errors.Join(ErrWebAuthnCeremony, err)
+	}
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+	return svc.db.queries(ctx).CreateWebAuthnCredential(ctx, model.CreateWebAuthnCredentialParams{
+		UserID:          user.user.ID,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		Aaguid:          credential.Authenticator.AAGUID,
+		SignCount:       int64(credential.Authenticator.SignCount),
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	})
+}
+
+// List returns the passkeys registered to the authenticated user.
+func (svc *WebAuthnService) List(ctx context.Context) ([]model.WebauthnCredential, error) {
+	return svc.db.readQueries(ctx).ListWebAuthnCredentials(ctx, UserFromFromContext(ctx).UserID)
+}
+
+// BeginLogin starts a discoverable login, the authenticator picks the account.
+func (svc *WebAuthnService) BeginLogin(ctx context.Context) (string, *protocol.CredentialAssertion, error) {
+	assertion, session, err := svc.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := svc.saveCeremony(ctx, session)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, assertion, nil
+}
+
+// FinishLogin verifies the assertion and issues the same session as
+// AuthService.Login.
+func (svc *WebAuthnService) FinishLogin(ctx context.Context, ceremonyID string, body io.Reader) (AuthOutput, error) {
+	session, err := svc.takeCeremony(ctx, ceremonyID)
+	if err != nil {
+		if err == ErrWebAuthnCeremony {
+			return AuthOutput{OK: false}, nil
+		}
+		return AuthOutput{}, err
+	}
+	response, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return AuthOutput{OK: false}, nil
+	}
+	var user *webAuthnUser
+	credential, err := svc.webAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		if len(userHandle) != 8 {
+			return nil, ErrWebAuthnCeremony
+		}
+		user, err = svc.loadUser(ctx, int64(binary.BigEndian.Uint64(userHandle)))
+		return user, err
+	}, session, response)
+	if err != nil {
+		// an unknown credential or a bad signature just means they cannot login
+		return AuthOutput{OK: false}, nil
+	}
+	if credential.Authenticator.CloneWarning {
+		return AuthOutput{OK: false}, nil
+	}
+	err = svc.db.queries(ctx).UpdateWebAuthnCredential(ctx, model.UpdateWebAuthnCredentialParams{
+		SignCount:    int64(credential.Authenticator.SignCount),
+		BackupState:  credential.Flags.BackupState,
+		CredentialID: credential.ID,
+	})
+	if err != nil {
+		return AuthOutput{}, err
+	}
+	teamUser, err := svc.db.queries(ctx).GetDefaultTeamUser(ctx, user.user.ID)
+	if err != nil {
+		return AuthOutput{}, err
+	}
+	token, err := createSession(ctx, svc.db.queries(ctx), teamUser.ID)
+	if err == errAccountDisabled {
+		return AuthOutput{OK: false}, nil
+	}
+	if err != nil {
+		return AuthOutput{}, err
+	}
+	return AuthOutput{
+		Token: token,
+		OK:    true,
+	}, nil
+}
@@ -0,0 +1,293 @@
+package sqlite_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"sqlite"
+	"sqlite/model"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const testOrigin = "http://localhost:8000"
+
+// softAuthenticator is a minimal platform authenticator holding a single
+// ES256 passkey, enough to drive both ceremonies end to end.
+type softAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{
+		t:            t,
+		key:          key,
+		credentialID: credentialID,
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge protocol.URLEncodedBase64) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": b64(challenge),
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) create(creation *protocol.CredentialCreation) []byte {
+	options := creation.Response
+	a.userHandle = options.User.ID.(protocol.URLEncodedBase64)
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	attested := make([]byte, 16) // zero aaguid
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	// user present, user verified, attested credential data
+	authData := a.authData(options.RelyingParty.ID, 0x01|0x04|0x40, attested)
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credentialID),
+		"rawId": b64(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", options.Challenge)),
+			"attestationObject": b64(attestation),
+		},
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return body
+}
+
+func (a *softAuthenticator) get(assertion *protocol.CredentialAssertion) []byte {
+	options := assertion.Response
+	a.signCount++
+	authData := a.authData(options.RelyingPartyID, 0x01|0x04, nil)
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credentialID),
+		"rawId": b64(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return body
+}
+
+func TestWebAuthnService(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.CreateAndMigrateDb(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	authService := sqlite.NewAuthService(db, sqlite.AuthConfig{})
+	svc, err := sqlite.NewWebAuthnService(db, sqlite.WebAuthnConfig{
+		RPID:          "localhost",
+		RPDisplayName: "Dials",
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	output, err := authService.Signup(ctx, sqlite.AuthInput{
+		UserName: "test",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	teamUser, err := authService.GetTeamUserFromSession(ctx, output.Token)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	userCtx := sqlite.ContextWithUser(ctx, teamUser)
+
+	// register a passkey for the logged in user
+	authenticator := newSoftAuthenticator(t)
+	id, creation, err := svc.BeginRegistration(userCtx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	err = svc.FinishRegistration(userCtx, id, bytes.NewReader(authenticator.create(creation)))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	passkeys, err := svc.List(userCtx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if len(passkeys) != 1 {
+		t.Fatalf("expected one passkey, got %d", len(passkeys))
+	}
+
+	// the registration challenge cannot be answered twice
+	err = svc.FinishRegistration(userCtx, id, bytes.NewReader(authenticator.create(creation)))
+	if err != sqlite.ErrWebAuthnCeremony {
+		t.Fatalf("expected ErrWebAuthnCeremony, got %v", err)
+	}
+
+	// log in with the passkey
+	id, assertion, err := svc.BeginLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	login, err := svc.FinishLogin(ctx, id, bytes.NewReader(authenticator.get(assertion)))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if !login.OK {
+		t.Fatal("expected successful login")
+	}
+	identity, err := authService.GetTeamUserFromSession(ctx, login.Token)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if identity.ID != teamUser.ID {
+		t.Fatalf("expected team user %d, got %d", teamUser.ID, identity.ID)
+	}
+
+	// an expired challenge cannot be answered, even if it's otherwise valid
+	id, assertion, err = svc.BeginLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	ceremony, err := db.Queries.TakeWebAuthnSession(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	err = db.Queries.CreateWebAuthnSession(ctx, model.CreateWebAuthnSessionParams{
+		ID:        id,
+		Data:      ceremony.Data,
+		ExpiresAt: time.Now().UTC().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	login, err = svc.FinishLogin(ctx, id, bytes.NewReader(authenticator.get(assertion)))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if login.OK {
+		t.Fatal("expected an expired ceremony to fail")
+	}
+
+	// a passkey the server has never seen cannot log in
+	id, assertion, err = svc.BeginLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	stranger := newSoftAuthenticator(t)
+	stranger.userHandle = authenticator.userHandle
+	login, err = svc.FinishLogin(ctx, id, bytes.NewReader(stranger.get(assertion)))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if login.OK {
+		t.Fatal("expected failed login")
+	}
+
+	// a replayed signature counter is rejected
+	id, assertion, err = svc.BeginLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	authenticator.signCount = 0
+	login, err = svc.FinishLogin(ctx, id, bytes.NewReader(authenticator.get(assertion)))
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	if login.OK {
+		t.Fatal("expected failed login")
+	}
+}